@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+const CodeAppendUid imap.StatusRespCode = "APPENDUID"
+
+// RefusedError is a NO or BAD answer to a command, as opposed to a broken connection.
+type RefusedError struct {
+	Info string
+}
+
+func (e *RefusedError) Error() string {
+	return e.Info
+}
+
+// statusErr is like status.Err but reports NO and BAD as a *RefusedError.
+func statusErr(status *imap.StatusResp) error {
+	if e := status.Err(); e != nil && status != nil {
+		return &RefusedError{status.Info}
+	} else {
+		return e
+	}
+}
+
+// AppendRequest is a single message to be appended by AppendBatch.
+// Uid and Err are filled in with the outcome for this message.
+type AppendRequest struct {
+	Flags     []string
+	Date      time.Time
+	Message   imap.Literal
+	MessageId string
+
+	Uid uint32
+	Err error
+}
+
+// MultiAppend is an APPEND command with several messages, as defined in RFC 3502.
+type MultiAppend struct {
+	Mailbox  string
+	Messages []*AppendRequest
+}
+
+func (cmd *MultiAppend) Command() *imap.Command {
+	args := []interface{}{imap.FormatMailboxName(EncodeMailboxName(cmd.Mailbox))}
+	for _, m := range cmd.Messages {
+		if m.Flags != nil {
+			flags := make([]interface{}, len(m.Flags))
+			for i, flag := range m.Flags {
+				flags[i] = imap.RawString(flag)
+			}
+			args = append(args, flags)
+		}
+		if !m.Date.IsZero() {
+			args = append(args, m.Date)
+		}
+		args = append(args, m.Message)
+	}
+	return &imap.Command{
+		Name:      "APPEND",
+		Arguments: args,
+	}
+}
+
+// AppendBatch appends reqs to mbox, filling in Uid and Err of each request.
+// With MULTIAPPEND the whole batch is sent as one command. MULTIAPPEND succeeds or fails as a unit,
+// so when it is refused the messages are appended one by one and only the refused ones fail;
+// the literals must therefore be readable again after Close, like StreamLiteral.
+// Without MULTIAPPEND every message costs a round trip. go-imap would take concurrent
+// Execute calls, but it does not serialise their writes, and the tagged reply to one APPEND
+// cancels whichever literal is waiting for its continuation, so the next APPEND would fail
+// as soon as the one before completes. Servers without UIDPLUS need one search for the
+// whole batch on top.
+// The returned error is only set when the connection itself is broken.
+func AppendBatch(c *client.Client, mbox string, reqs []*AppendRequest) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+	single := reqs
+	if ok, _ := c.Support("MULTIAPPEND"); ok {
+		// literal8 messages go on their own
+		var batch []*AppendRequest
+		single = nil
+		for _, r := range reqs {
+			if needsLiteral8(c, r) {
+				single = append(single, r)
+			} else {
+				batch = append(batch, r)
+			}
+		}
+		if len(batch) < 2 {
+			single = reqs
+		} else if refused, e := multiAppend(c, mbox, batch); e != nil {
+			return e
+		} else if refused {
+			for _, r := range batch {
+				if cl, ok := r.Message.(io.Closer); ok {
+					cl.Close()
+				}
+			}
+			single = reqs
+		}
+	}
+	for _, r := range single {
+		r.Uid, r.Err = appendOne(c, mbox, r)
+		if _, refused := r.Err.(*RefusedError); r.Err != nil && !refused {
+			return r.Err
+		}
+	}
+	return searchMessageIds(c, reqs)
+}
+
+// multiAppend sends reqs as a single MULTIAPPEND and takes their UIDs from APPENDUID.
+func multiAppend(c *client.Client, mbox string, reqs []*AppendRequest) (refused bool, e error) {
+	status, e := c.Execute(mailboxCommand(&MultiAppend{Mailbox: mbox, Messages: reqs}), nil)
+	if e != nil {
+		return false, e
+	} else if e := statusErr(status); e != nil {
+		_, refused := e.(*RefusedError)
+		if !refused {
+			return false, e
+		}
+		fmt.Fprintf(os.Stderr, "(MULTIAPPEND refused: %s, appending one by one) ", e)
+		return true, nil
+	}
+	var uids []uint32
+	if status.Code == CodeAppendUid && len(status.Arguments) == 2 {
+		if raw, e := imap.ParseString(status.Arguments[1]); e == nil {
+			if set, e := imap.ParseSeqSet(raw); e == nil {
+				for _, s := range set.Set {
+					for uid := s.Start; uid <= s.Stop; uid++ {
+						uids = append(uids, uid)
+					}
+				}
+			}
+		}
+	}
+	if len(uids) == len(reqs) {
+		for i, r := range reqs {
+			r.Uid = uids[i]
+		}
+	}
+	return false, nil
+}
+
+// appendOne appends a single message and returns the UID from APPENDUID, zero without UIDPLUS.
+func appendOne(c *client.Client, mbox string, r *AppendRequest) (uint32, error) {
+	if needsLiteral8(c, r) {
+		w := c.Writer()
+		lw := &literal8Writer{Writer: w.Writer, size: r.Message.Len()}
+		w.Writer = lw
+		defer func() { w.Writer = lw.Writer }()
+	}
+	cmd := &commands.Append{
+		Mailbox: mbox,
+		Flags:   r.Flags,
+		Date:    r.Date,
+		Message: r.Message,
+	}
+	status, e := c.Execute(mailboxCommand(cmd), nil)
+	if e != nil {
+		return 0, e
+	} else if e := statusErr(status); e != nil {
+		return 0, e
+	}
+	if status.Code == CodeAppendUid && len(status.Arguments) == 2 {
+		if uid, e := imap.ParseNumber(status.Arguments[1]); e == nil {
+			return uid, nil
+		}
+	}
+	return 0, nil
+}
+
+// needsLiteral8 reports whether r has binary content, which a plain literal may not carry,
+// and the server takes it as a literal8 (RFC 3516). Without BINARY it is sent as it is.
+func needsLiteral8(c *client.Client, r *AppendRequest) bool {
+	if l, ok := r.Message.(interface{ Binary() bool }); !ok || !l.Binary() {
+		return false
+	}
+	ok, _ := c.Support("BINARY")
+	return ok
+}
+
+// literal8Writer turns the literal of the given size written through it into a literal8,
+// which go-imap does not know, by putting "~" in front of its "{size}" announcement.
+type literal8Writer struct {
+	io.Writer
+	size int
+	done bool
+}
+
+func (w *literal8Writer) Write(p []byte) (int, error) {
+	if s, n := string(p), strconv.Itoa(w.size); !w.done && (s == "{"+n+"}\r\n" || s == "{"+n+"+}\r\n") {
+		w.done = true
+		if _, e := io.WriteString(w.Writer, "~"); e != nil {
+			return 0, e
+		}
+	}
+	return w.Writer.Write(p)
+}
+
+// Flush is passed on, go-imap flushes before it waits for the continuation.
+func (w *literal8Writer) Flush() error {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// searchMessageIds fills in the missing UIDs of the appended reqs (in the selected mailbox)
+// by Message-ID, with a single SEARCH and FETCH for the batch.
+// Requests without a Message-ID, or sharing one, are left at zero.
+func searchMessageIds(c *client.Client, reqs []*AppendRequest) error {
+	var criteria *imap.SearchCriteria
+	wanted := make(map[string][]*AppendRequest)
+	for _, r := range reqs {
+		if r.Uid != 0 || r.Err != nil || r.MessageId == "" {
+			continue
+		}
+		one := imap.NewSearchCriteria()
+		one.Header.Add("Message-Id", r.MessageId)
+		if criteria != nil {
+			one = &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{one, criteria}}}
+		}
+		criteria = one
+		wanted[r.MessageId] = append(wanted[r.MessageId], r)
+	}
+	if criteria == nil {
+		return nil
+	}
+	// make sure the server has told us about the new messages
+	if e := c.Noop(); e != nil {
+		return e
+	}
+	uids, e := SearchUids(c, criteria)
+	if e != nil {
+		return fmt.Errorf("searching for appended messages: %w", e)
+	} else if len(uids) == 0 {
+		return nil
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uids...)
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Message-Id"}},
+		Peek:         true,
+	}
+	ch, done := make(chan *imap.Message, 10), make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, ch)
+	}()
+	found := make(map[string]uint32)
+	for msg := range ch {
+		if r := msg.GetBody(section); r != nil {
+			if m, e := mail.ReadMessage(r); e == nil {
+				if id := m.Header.Get("Message-Id"); msg.Uid > found[id] {
+					found[id] = msg.Uid
+				}
+			}
+		}
+	}
+	if e := <-done; e != nil {
+		return e
+	}
+	for id, rs := range wanted {
+		if len(rs) == 1 {
+			rs[0].Uid = found[id]
+		}
+	}
+	return nil
+}
+
+// searchMessageId returns the highest UID in the selected mailbox with the given Message-ID.
+func searchMessageId(c *client.Client, message_id string) (uint32, error) {
+	if message_id == "" {
+		return 0, nil
+	}
+	// make sure the server has told us about the new message
+	if e := c.Noop(); e != nil {
+		return 0, e
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Message-Id", message_id)
+	uids, e := SearchUids(c, criteria)
+	if e != nil {
+		return 0, fmt.Errorf("searching for %s: %w", message_id, e)
+	}
+	var uid uint32
+	for _, u := range uids {
+		if u > uid {
+			uid = u
+		}
+	}
+	return uid, nil
+}
@@ -96,3 +96,33 @@ func forward(sourcedir, targetdir string) error {
 		}
 	})
 }
+
+// write_to_archive stores the message in r under its hash in targetdir and returns the name it got there.
+func write_to_archive(targetdir string, r io.Reader) (string, error) {
+	if e := os.MkdirAll(targetdir, os.ModePerm); e != nil {
+		return "", e
+	}
+	tmp, e := os.CreateTemp(targetdir, ".tmp")
+	if e != nil {
+		return "", e
+	}
+	hash := sha256.New()
+	if _, e := io.Copy(io.MultiWriter(tmp, hash), r); e != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", e
+	} else if e := tmp.Close(); e != nil {
+		os.Remove(tmp.Name())
+		return "", e
+	}
+	digest := hash.Sum(nil)
+	first_byte := fmt.Sprintf("%02x", digest[0])
+	rest_bytes := fmt.Sprintf("%02x", digest[1:])
+	if e := os.MkdirAll(filepath.Join(targetdir, first_byte), os.ModePerm); e != nil {
+		return "", e
+	}
+	if e := os.Rename(tmp.Name(), filepath.Join(targetdir, first_byte, rest_bytes)); e != nil {
+		return "", e
+	}
+	return filepath.Join(first_byte, rest_bytes), nil
+}
@@ -2,61 +2,242 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-sasl"
 )
 
+// Config is the json encoded configuration read by LoadConfig.
+type Config struct {
+	Type         string `json:"type"`
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	ImapServer   string `json:"imap_server"`
+	Directory    string `json:"directory"`
+	ClientId     string `json:"clientid"`
+	ClientSecret string `json:"clientsecret"`
+	RefreshToken string `json:"refreshtoken"`
+	// discover the folders with LIST on every sync instead of using the defaults for type.
+	// Folder renames (on either side) are only carried over in this mode; with fixed folders
+	// a renamed folder is deleted and downloaded or uploaded again under its new name
+	Discover bool `json:"discover"`
+	// glob patterns (path.Match) on the remote name narrowing the discovered folders
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+	// local directory layout of discovered folders, LayoutNested (default) or LayoutMaildirPP
+	Layout string `json:"layout"`
+	// for type "gmail": sync [Gmail]/All Mail only, with labels as keywords,
+	// so every message exists once locally
+	GmailLabels bool `json:"gmail_labels"`
+	// StorageVerbatim (default) keeps messages exactly as sent by the server,
+	// StorageFiltered keeps only the headers in header_list
+	Storage string `json:"storage"`
+	// line ending conversion when storing messages: LineEndingsKeep (default), LineEndingsLF or LineEndingsCRLF
+	LineEndings string `json:"line_endings"`
+	// what to do with local maildirs that are not in the folder list, one of
+	// CreateIgnore (default), CreateNotify or CreateRemote
+	CreatePolicy string `json:"create_policy"`
+	// what to do with messages above a size limit, see SizePolicy;
+	// folders without their own policy use these
+	UploadSize   *SizePolicy `json:"upload_size"`
+	DownloadSize *SizePolicy `json:"download_size"`
+	// download only the headers of messages older than this many days, see FetchFull
+	HeadersOlderThan int `json:"headers_older_than"`
+	// explicit folders by local name; the defaults for type are only a fallback
+	Folders map[string]*Folder `json:"folders"`
+}
+
+// Folder holds the options of a single synced folder.
+type Folder struct {
+	// remote mailbox name, defaults to the local name
+	Remote string `json:"remote"`
+	// local messages larger than this (in bytes) go to the offline archive instead of being uploaded,
+	// short for upload_size with SizeOffline
+	SizeLimit int64 `json:"size_limit"`
+	// override the size policies of the account for this folder
+	UploadSize       *SizePolicy `json:"upload_size"`
+	DownloadSize     *SizePolicy `json:"download_size"`
+	HeadersOlderThan int         `json:"headers_older_than"`
+	// only sync messages from the last this many days, see applyWindow
+	Days int `json:"days"`
+	// wait for new mail in this folder with IDLE
+	Watch bool `json:"watch"`
+	// one of DirectionBoth (default), DirectionPull or DirectionPush
+	Direction string `json:"direction"`
+	// SPECIAL-USE attribute (e.g. "\\Sent") given to the remote mailbox when it has to be created
+	SpecialUse string `json:"special_use"`
+	// sync Gmail labels (X-GM-LABELS) as keywords, see Keywords
+	Labels bool `json:"labels"`
+	// override the storage and line_endings of the account for this folder
+	Storage     string `json:"storage"`
+	LineEndings string `json:"line_endings"`
+	// headers kept and added when storing downloaded messages and when uploading,
+	// see HeaderPolicy; without one StorageFiltered falls back to header_list
+	DownloadHeaders *HeaderPolicy `json:"download_headers"`
+	UploadHeaders   *HeaderPolicy `json:"upload_headers"`
+
+	// placeholders of HeaderPolicy.Add, filled in for every sync
+	vars map[string]string
+	// maildir for messages which cannot be parsed, see MemoryMailbox.Quarantine
+	quarantine string
+	// content-addressed archive for messages over the size limits
+	offline string
+}
+
+// headerPolicy returns the header policy for downloads or uploads, nil to keep the message as it is.
+func (f *Folder) headerPolicy(upload bool) *HeaderPolicy {
+	if p := f.DownloadHeaders; !upload && p != nil {
+		return p
+	} else if p := f.UploadHeaders; upload && p != nil {
+		return p
+	} else if f.Storage == StorageFiltered {
+		return filtered_policy
+	}
+	return nil
+}
+
+const (
+	// upload and download, including deletions on both sides
+	DirectionBoth = "both"
+	// mirror the server, never modify it
+	DirectionPull = "pull"
+	// upload local messages, never delete anything locally
+	DirectionPush = "push"
+)
+
 // LoadConfig loads a configuration file (json encoded) and returns the relevant information.
-// addr (hostname:port format) is the remote address for which to make a connection.
-// folder_list (map[local_name]remote_name) is the list of folders for which to sync; default values are "inbox", "sent", and "archive".
-// directory is the root directory containing the maildir
+// cfg holds the decoded file; cfg.ImapServer (hostname:port format) is the remote address and
+// cfg.Directory is the root directory containing the maildir.
+// folder_list (map[local_name]folder) is the list of folders for which to sync; cfg.Folders if given, otherwise "inbox", "sent", and "archive".
 // mem represents the local representation of the mailbox
-func LoadConfig(r io.Reader) (addr string, a sasl.Client, folder_list map[string]string, directory string, mem *Memory, e error) {
-	userinfo := make(map[string]string)
+func LoadConfig(r io.Reader) (cfg *Config, a sasl.Client, folder_list map[string]*Folder, mem *Memory, e error) {
+	cfg = new(Config)
 
 	// load config from os.Stdin
 	dec := json.NewDecoder(r)
-	if e = dec.Decode(&userinfo); e != nil {
+	if e = dec.Decode(cfg); e != nil {
 		return
 	}
-	directory = userinfo["directory"]
-	os.MkdirAll(directory, os.ModePerm)
+	os.MkdirAll(cfg.Directory, os.ModePerm)
 
 	// load memory file
-	if m, err := MemoryInit(filepath.Join(directory, ".memory.json")); err != nil || m == nil || m.Boxes == nil {
+	if m, err := MemoryInit(filepath.Join(cfg.Directory, ".memory.json")); err != nil || m == nil || m.Boxes == nil {
 		mem = &Memory{
-			filename: filepath.Join(directory, ".memory.json"),
+			filename: filepath.Join(cfg.Directory, ".memory.json"),
 			Boxes:    make(map[string]MemoryMailbox),
 		}
 	} else {
 		mem = m
 	}
-	addr = userinfo["imap_server"]
-	switch userinfo["type"] {
+	switch cfg.Layout {
+	case "":
+		cfg.Layout = LayoutNested
+	case LayoutNested, LayoutMaildirPP:
+	default:
+		e = fmt.Errorf("unknown layout %q", cfg.Layout)
+		return
+	}
+	switch cfg.Storage {
+	case "":
+		cfg.Storage = StorageVerbatim
+	case StorageVerbatim, StorageFiltered:
+	default:
+		e = fmt.Errorf("unknown storage %q", cfg.Storage)
+		return
+	}
+	switch cfg.LineEndings {
+	case LineEndingsKeep, LineEndingsLF, LineEndingsCRLF:
+	default:
+		e = fmt.Errorf("unknown line_endings %q", cfg.LineEndings)
+		return
+	}
+	switch cfg.CreatePolicy {
+	case "":
+		cfg.CreatePolicy = CreateIgnore
+	case CreateIgnore, CreateNotify, CreateRemote:
+	default:
+		e = fmt.Errorf("unknown create_policy %q", cfg.CreatePolicy)
+		return
+	}
+	for i, p := range []*SizePolicy{cfg.UploadSize, cfg.DownloadSize} {
+		if p == nil {
+			continue
+		} else if e = p.check(i == 1); e != nil {
+			return
+		}
+	}
+	switch cfg.Type {
 	case "plain":
-		a = sasl.NewPlainClient("", userinfo["user"], userinfo["password"])
-		folder_list = make(map[string]string)
-		folder_list["inbox"] = "INBOX"
-		folder_list["sent"] = "sent"
-		folder_list["archive"] = "archive"
+		a = sasl.NewPlainClient("", cfg.User, cfg.Password)
+		folder_list = make(map[string]*Folder)
+		folder_list["inbox"] = &Folder{Remote: "INBOX", Watch: true}
+		folder_list["sent"] = &Folder{Remote: "sent", SpecialUse: imap.SentAttr}
+		folder_list["archive"] = &Folder{Remote: "archive", SpecialUse: imap.ArchiveAttr}
 	case "gmail":
-		config, token := Gmail_Generate_Token(userinfo["clientid"], userinfo["clientsecret"], userinfo["refreshtoken"])
-		a = XOAuth2(userinfo["user"], config, token)
-		folder_list = make(map[string]string)
-		folder_list["inbox"] = "INBOX"
-		folder_list["sent"] = "[Gmail]/Sent Mail"
+		config, token := Gmail_Generate_Token(cfg.ClientId, cfg.ClientSecret, cfg.RefreshToken)
+		a = XOAuth2(cfg.User, config, token)
+		folder_list = make(map[string]*Folder)
+		if cfg.GmailLabels {
+			// labels instead of folders, INBOX is just the \Inbox label
+			folder_list["all"] = &Folder{Remote: "[Gmail]/All Mail", Watch: true, SpecialUse: imap.AllAttr, Labels: true}
+			break
+		}
+		folder_list["inbox"] = &Folder{Remote: "INBOX", Watch: true}
+		folder_list["sent"] = &Folder{Remote: "[Gmail]/Sent Mail", SpecialUse: imap.SentAttr}
 		// gmail had a strange archival system
 		// does not work well with IMAP
 	case "outlook":
-		config, token := Outlook_Generate_Token(userinfo["clientid"], userinfo["refreshtoken"])
-		a = XOAuth2(userinfo["user"], config, token)
-		folder_list = make(map[string]string)
-		folder_list["inbox"] = "INBOX"
-		folder_list["sent"] = "Sent Items"
-		folder_list["archive"] = "Archive"
+		config, token := Outlook_Generate_Token(cfg.ClientId, cfg.RefreshToken)
+		a = XOAuth2(cfg.User, config, token)
+		folder_list = make(map[string]*Folder)
+		folder_list["inbox"] = &Folder{Remote: "INBOX", Watch: true}
+		folder_list["sent"] = &Folder{Remote: "Sent Items", SpecialUse: imap.SentAttr}
+		folder_list["archive"] = &Folder{Remote: "Archive", SpecialUse: imap.ArchiveAttr}
+	}
+	if len(cfg.Folders) > 0 {
+		folder_list = cfg.Folders
+		for title, f := range folder_list {
+			if f == nil {
+				f = new(Folder)
+				folder_list[title] = f
+			}
+			if f.Remote == "" {
+				f.Remote = title
+			}
+			// names copied from other tools are often still modified UTF-7
+			f.Remote = DecodeMailboxName(f.Remote)
+			switch f.Direction {
+			case "":
+				f.Direction = DirectionBoth
+			case DirectionBoth, DirectionPull, DirectionPush:
+			default:
+				e = fmt.Errorf("folder %s: unknown direction %q", title, f.Direction)
+				return
+			}
+			for _, p := range []*HeaderPolicy{f.DownloadHeaders, f.UploadHeaders} {
+				if p == nil {
+					continue
+				} else if e = p.Compile(); e != nil {
+					e = fmt.Errorf("folder %s: %w", title, e)
+					return
+				}
+			}
+			if f.SizeLimit > 0 && f.UploadSize == nil {
+				f.UploadSize = &SizePolicy{Limit: f.SizeLimit, Action: SizeOffline}
+			}
+			for i, p := range []*SizePolicy{f.UploadSize, f.DownloadSize} {
+				if p == nil {
+					continue
+				} else if e = p.check(i == 1); e != nil {
+					e = fmt.Errorf("folder %s: %w", title, e)
+					return
+				}
+			}
+		}
 	}
 	return
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// local names for the SPECIAL-USE attributes of RFC 6154
+var special_use = map[string]string{
+	imap.SentAttr:    "sent",
+	imap.ArchiveAttr: "archive",
+	imap.DraftsAttr:  "drafts",
+	imap.TrashAttr:   "trash",
+	imap.JunkAttr:    "junk",
+	imap.AllAttr:     "all",
+}
+
+// matchAny reports whether name matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// local names (or top directories) used by the tool itself: the offline store (and the maildir -a archives into it),
+// the quarantine, the control socket and the memory file
+var reserved_names = map[string]bool{
+	"offline":      true,
+	"quarantine":   true,
+	"archive":      true,
+	".socket":      true,
+	".memory.json": true,
+}
+
+// DiscoverFolders lists the remote mailboxes and returns them as a folder_list.
+// INBOX and mailboxes with a SPECIAL-USE attribute get a stable local name ("inbox", "sent", ...),
+// every other mailbox is named after its remote name according to cfg.Layout.
+// Mailboxes are kept when they match cfg.Include (or it is empty) and do not match cfg.Exclude.
+// Folders configured in cfg.Folders take precedence over discovered ones.
+func DiscoverFolders(c *client.Client, cfg *Config) (map[string]*Folder, error) {
+	infos, e := ListMailboxes(c)
+	if e != nil {
+		return nil, e
+	}
+	// deterministic choice when two mailboxes claim the same name
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	folder_list := make(map[string]*Folder)
+	var plain []*imap.MailboxInfo
+OUTER:
+	for _, info := range infos {
+		if len(cfg.Include) > 0 && !matchAny(cfg.Include, info.Name) || matchAny(cfg.Exclude, info.Name) {
+			continue
+		}
+		for _, attr := range info.Attributes {
+			if strings.EqualFold(attr, imap.NoSelectAttr) || strings.EqualFold(attr, "\\NonExistent") {
+				continue OUTER
+			}
+		}
+		if strings.EqualFold(info.Name, "INBOX") {
+			folder_list["inbox"] = &Folder{Remote: info.Name, Watch: true}
+			continue
+		}
+		for _, attr := range info.Attributes {
+			for a, title := range special_use {
+				if _, taken := folder_list[title]; strings.EqualFold(attr, a) && !taken {
+					folder_list[title] = &Folder{Remote: info.Name, SpecialUse: a}
+					continue OUTER
+				}
+			}
+		}
+		plain = append(plain, info)
+	}
+	for _, info := range plain {
+		title := LocalName(info.Name, info.Delimiter, cfg.Layout)
+		if reserved_names[strings.SplitN(filepath.ToSlash(title), "/", 2)[0]] {
+			fmt.Fprintf(os.Stderr, "not syncing %s, the local name %s is reserved; configure it under folders\n", info.Name, title)
+			continue
+		}
+		if _, taken := folder_list[title]; !taken {
+			folder_list[title] = &Folder{Remote: info.Name}
+		}
+	}
+	for title, f := range cfg.Folders {
+		for t, g := range folder_list {
+			if g.Remote == f.Remote {
+				delete(folder_list, t)
+			}
+		}
+		folder_list[title] = f
+	}
+	return folder_list, nil
+}
@@ -1,40 +1,168 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-maildir"
 )
 
-type FlagUpdateRequest struct {
-	uid   uint32
-	flags []interface{}
+// FlagPushes collects flags to be added on the remote, grouped by identical flag sets
+// so that a few UID STORE commands cover all messages.
+type FlagPushes map[string]*flagPush
+
+type flagPush struct {
+	uids   *imap.SeqSet
+	flags  []interface{}
+	labels []interface{}
+}
+
+// Add queues flags (and Gmail labels) to be added to the message uid.
+func (p FlagPushes) Add(uid uint32, flags []interface{}, labels []interface{}) {
+	key := fmt.Sprint(flags, labels)
+	if p[key] == nil {
+		p[key] = &flagPush{new(imap.SeqSet), flags, labels}
+	}
+	p[key].uids.AddNum(uid)
+}
+
+// Store sends the queued flags, one UID STORE per flag set.
+func (p FlagPushes) Store(c *client.Client) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	for _, push := range p {
+		if flags := pushableFlags(c, push.flags); len(flags) > 0 {
+			if e := c.UidStore(push.uids, item, flags, nil); e != nil {
+				return e
+			}
+		}
+		if len(push.labels) > 0 {
+			if e := StoreLabels(c, push.uids, true, push.labels); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// pushableFlags drops the flags the selected mailbox does not keep (see Storable) from flags,
+// and \Deleted unless the server has UIDPLUS: a local T would otherwise be expunged
+// for good by the next plain EXPUNGE, see expungeUids.
+func pushableFlags(c *client.Client, flags []interface{}) []interface{} {
+	uidplus, _ := c.Support("UIDPLUS")
+	keep := NewStorable(c.Mailbox())
+	out := make([]interface{}, 0, len(flags))
+	for _, f := range flags {
+		if s, _ := f.(string); (s != imap.DeletedFlag || uidplus) && keep.Has(s) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Storable holds the PERMANENTFLAGS of a mailbox, lowercased; nil when the server did not
+// send them, which means that all flags are kept (RFC 3501 7.1).
+type Storable map[string]bool
+
+func NewStorable(mbox *imap.MailboxStatus) Storable {
+	if mbox == nil || mbox.PermanentFlags == nil {
+		return nil
+	}
+	keep := make(Storable)
+	for _, f := range mbox.PermanentFlags {
+		keep[strings.ToLower(f)] = true
+	}
+	return keep
+}
+
+// Has reports whether the mailbox keeps the flag f; \* allows any keyword.
+func (keep Storable) Has(f string) bool {
+	return keep == nil || keep[strings.ToLower(f)] || keep[imap.TryCreateFlag] && !strings.HasPrefix(f, "\\")
+}
+
+// maildir flags and the IMAP flags they correspond to
+// (T is only pushed as \Deleted with UIDPLUS, see pushableFlags)
+var flag_map = []struct {
+	local  maildir.Flag
+	remote string
+}{
+	{maildir.FlagPassed, "$Forwarded"},
+	{maildir.FlagReplied, imap.AnsweredFlag},
+	{maildir.FlagSeen, imap.SeenFlag},
+	{maildir.FlagTrashed, imap.DeletedFlag},
+	{maildir.FlagDraft, imap.DraftFlag},
+	{maildir.FlagFlagged, imap.FlaggedFlag},
 }
 
 // flag handler
-func parseFlags(in_flags []string) (out_flags []maildir.Flag) {
+// keywords (anything not starting with a backslash) are stored as lowercase letters through kw
+func parseFlags(in_flags []string, kw *Keywords) (out_flags []maildir.Flag) {
+OUTER:
 	for _, f := range in_flags {
-		switch f {
-		case "\\Seen":
-			out_flags = append(out_flags, maildir.FlagSeen)
-		case "\\Answered":
-			out_flags = append(out_flags, maildir.FlagReplied)
+		for _, m := range flag_map {
+			if strings.EqualFold(f, m.remote) {
+				out_flags = append(out_flags, m.local)
+				continue OUTER
+			}
+		}
+		if !strings.HasPrefix(f, "\\") && kw != nil {
+			if l, ok := kw.Flag(f); ok {
+				out_flags = append(out_flags, l)
+			}
 		}
 	}
 	return
 }
-func deparseFlags(in_flags []maildir.Flag) (out_flags []interface{}) {
+func deparseFlags(in_flags []maildir.Flag, kw *Keywords) (out_flags []interface{}) {
+OUTER:
 	for _, f := range in_flags {
-		switch f {
-		case maildir.FlagSeen:
-			out_flags = append(out_flags, imap.SeenFlag)
-		case maildir.FlagReplied:
-			out_flags = append(out_flags, imap.AnsweredFlag)
+		for _, m := range flag_map {
+			if f == m.local {
+				out_flags = append(out_flags, m.remote)
+				continue OUTER
+			}
+		}
+		if kw != nil {
+			if k, ok := kw.Keyword(f); ok {
+				out_flags = append(out_flags, k)
+			}
 		}
 	}
 	return
 }
 
-func SyncFlags(key string, D maildir.Dir, raw_remote_flags []string) ([]interface{}, error) {
+// knownFlag reports whether f has an IMAP counterpart which the server keeps.
+func knownFlag(f maildir.Flag, kw *Keywords, keep Storable) bool {
+	for _, m := range flag_map {
+		if f == m.local {
+			return keep.Has(m.remote)
+		}
+	}
+	k, ok := kw.Keyword(f)
+	return ok && keep.Has(k)
+}
+
+// SyncFlags merges the local and remote flags (and keywords) of a message and returns the flags to add on the remote.
+// With DirectionPull the local flags simply follow the remote ones,
+// with DirectionPush the local flags are left alone. Only flags in keep are taken for missing on the remote.
+func SyncFlags(key string, D maildir.Dir, raw_remote_flags []string, direction string, kw *Keywords, keep Storable) ([]interface{}, error) {
+	if fl, e := syncFlags(key, D, parseFlags(raw_remote_flags, kw), direction, kw, keep); e != nil || fl == nil {
+		return nil, e
+	} else {
+		return deparseFlags(fl, kw), nil
+	}
+}
+
+// syncFlags is SyncFlags on parsed remote flags; it returns the merged maildir flags
+// when the remote is missing some of them.
+func syncFlags(key string, D maildir.Dir, remote_flags []maildir.Flag, direction string, kw *Keywords, keep Storable) ([]maildir.Flag, error) {
+	if direction == DirectionPull {
+		if cur_flags, e := D.Flags(key); e == nil && sameFlags(cur_flags, remote_flags) {
+			return nil, nil
+		}
+		return nil, D.SetFlags(key, remote_flags)
+	}
 	raw_flags := make([]maildir.Flag, 0)
 	var length int = 0
 	// get local flags
@@ -45,7 +173,6 @@ func SyncFlags(key string, D maildir.Dir, raw_remote_flags []string) ([]interfac
 		}
 	}
 	// get remote flags
-	remote_flags := parseFlags(raw_remote_flags)
 	for _, t := range remote_flags {
 		raw_flags = append(raw_flags, t)
 	}
@@ -55,16 +182,19 @@ func SyncFlags(key string, D maildir.Dir, raw_remote_flags []string) ([]interfac
 
 	local_and_global_flags := make([]maildir.Flag, 0)
 	// delete repeats
-	for _, f := range []maildir.Flag{maildir.FlagSeen, maildir.FlagReplied} {
-		for _, a := range raw_flags {
-			if a == f {
-				local_and_global_flags = append(local_and_global_flags, f)
-				break
+	seen := make(map[maildir.Flag]bool)
+	var known int
+	for _, a := range raw_flags {
+		if !seen[a] {
+			seen[a] = true
+			local_and_global_flags = append(local_and_global_flags, a)
+			if knownFlag(a, kw, keep) {
+				known++
 			}
 		}
 	}
 
-	if length < len(local_and_global_flags) {
+	if length < len(local_and_global_flags) && direction != DirectionPush {
 		// some flags got added remote -> local
 		// fmt.Println("R -> L", msg.SeqNum, key)
 		if e := D.SetFlags(key, local_and_global_flags); e != nil {
@@ -72,11 +202,25 @@ func SyncFlags(key string, D maildir.Dir, raw_remote_flags []string) ([]interfac
 		}
 	}
 
-	if len(remote_flags) < len(local_and_global_flags) {
+	if len(remote_flags) < known {
 		// some flags got added local -> remote
 		// fmt.Println("L -> R", msg.SeqNum, key)
-		return deparseFlags(local_and_global_flags), nil
+		return local_and_global_flags, nil
 	}
 
 	return nil, nil
 }
+
+// sameFlags reports whether a and b hold the same set of flags.
+func sameFlags(a, b []maildir.Flag) bool {
+	set := make(map[maildir.Flag]bool)
+	for _, f := range a {
+		set[f] = true
+	}
+	for _, f := range b {
+		if !set[f] {
+			return false
+		}
+	}
+	return len(set) == len(b)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestStorableHas(t *testing.T) {
+	tests := []struct {
+		permanent []string
+		flag      string
+		has       bool
+	}{
+		{nil, "$Forwarded", true},
+		{[]string{imap.SeenFlag}, imap.SeenFlag, true},
+		{[]string{imap.SeenFlag}, "$Forwarded", false},
+		{[]string{imap.SeenFlag, imap.TryCreateFlag}, "$Forwarded", true},
+		{[]string{imap.SeenFlag, imap.TryCreateFlag}, imap.DeletedFlag, false},
+		{[]string{"$forwarded"}, "$Forwarded", true},
+	}
+	for _, tt := range tests {
+		keep := NewStorable(&imap.MailboxStatus{PermanentFlags: tt.permanent})
+		if got := keep.Has(tt.flag); got != tt.has {
+			t.Errorf("PERMANENTFLAGS %v: Has(%q) = %v, want %v", tt.permanent, tt.flag, got, tt.has)
+		}
+	}
+}
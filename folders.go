@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+const (
+	// leave new local maildirs alone
+	CreateIgnore = "ignore"
+	// print a note about new local maildirs
+	CreateNotify = "notify"
+	// create new local maildirs on the server and sync them
+	CreateRemote = "create"
+)
+
+// CreateSpecialUse is a CREATE command with a USE parameter, as defined in RFC 6154 section 3.
+type CreateSpecialUse struct {
+	Mailbox string
+	Use     string
+}
+
+func (cmd *CreateSpecialUse) Command() *imap.Command {
+	use := []interface{}{imap.RawString("USE"), []interface{}{imap.RawString(cmd.Use)}}
+	return &imap.Command{
+		Name:      "CREATE",
+		Arguments: []interface{}{imap.FormatMailboxName(EncodeMailboxName(cmd.Mailbox)), use},
+	}
+}
+
+// createMailbox creates and subscribes the remote mailbox of folder.
+func createMailbox(c *client.Client, folder *Folder) error {
+	fmt.Fprintf(os.Stderr, "%s creating remote %s\n", time.Now().Format("15:04:05"), folder.Remote)
+	if ok, _ := c.Support("CREATE-SPECIAL-USE"); ok && folder.SpecialUse != "" {
+		if status, e := c.Execute(mailboxCommand(&CreateSpecialUse{folder.Remote, folder.SpecialUse}), nil); e != nil {
+			return e
+		} else if e := statusErr(status); e != nil {
+			return e
+		}
+	} else if status, e := c.Execute(mailboxCommand(&commands.Create{Mailbox: folder.Remote}), nil); e != nil {
+		return e
+	} else if e := statusErr(status); e != nil {
+		return e
+	}
+	if status, e := c.Execute(mailboxCommand(&commands.Subscribe{Mailbox: folder.Remote}), nil); e != nil {
+		return e
+	} else if e := status.Err(); e != nil {
+		// not subscribing is no reason to stop
+		fmt.Fprintf(os.Stderr, "subscribing %s: %s\n", folder.Remote, e)
+	}
+	return nil
+}
+
+// refused reports (and prints) whether e is the server refusing to create a mailbox.
+func refused(e error, name string) bool {
+	if _, ok := e.(*RefusedError); ok {
+		fmt.Fprintf(os.Stderr, "cannot create %s, skipping: %s\n", name, e)
+		return true
+	}
+	return false
+}
+
+// localMaildirs returns the local names of all maildirs below directory.
+func localMaildirs(directory string) ([]string, error) {
+	var titles []string
+	e := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "cur", "new", "tmp":
+			return fs.SkipDir
+		}
+		if path == directory {
+			return nil
+		}
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if i, e := os.Stat(filepath.Join(path, sub)); e != nil || !i.IsDir() {
+				return nil
+			}
+		}
+		title, e := filepath.Rel(directory, path)
+		if e != nil {
+			return e
+		}
+		titles = append(titles, title)
+		return nil
+	})
+	return titles, e
+}
+
+// EnsureFolders makes both sides match folder_list and returns the folders to sync in this pass.
+// Remote mailboxes which do not exist are created, except for pull-only folders, which are
+// left out of this pass; so are folders whose CREATE the server refuses.
+// Local maildirs which are not in folder_list are handled according to cfg.CreatePolicy;
+// with CreateRemote they are created on the server and added to folder_list.
+func EnsureFolders(c *client.Client, cfg *Config, folder_list map[string]*Folder) (active map[string]*Folder, e error) {
+	infos, e := ListMailboxes(c)
+	if e != nil {
+		return nil, e
+	}
+	active = make(map[string]*Folder)
+	exists := make(map[string]bool)
+	var delim string
+	for _, info := range infos {
+		exists[info.Name] = true
+		if delim == "" {
+			delim = info.Delimiter
+		}
+	}
+	for title, folder := range folder_list {
+		if exists[folder.Remote] || strings.EqualFold(folder.Remote, "INBOX") {
+			active[title] = folder
+			continue
+		} else if folder.Direction == DirectionPull {
+			fmt.Fprintf(os.Stderr, "remote %s does not exist, skipping %s\n", folder.Remote, title)
+			continue
+		}
+		if e := createMailbox(c, folder); refused(e, folder.Remote) {
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+		exists[folder.Remote] = true
+		active[title] = folder
+	}
+
+	if cfg.CreatePolicy == CreateIgnore {
+		return active, nil
+	}
+	titles, e := localMaildirs(cfg.Directory)
+	if e != nil {
+		return nil, e
+	}
+	known := make(map[string]bool)
+	for title := range folder_list {
+		known[filepath.Clean(title)] = true
+	}
+	for _, title := range titles {
+		if known[title] || reserved_names[strings.SplitN(filepath.ToSlash(title), "/", 2)[0]] {
+			continue
+		}
+		if cfg.Layout == LayoutMaildirPP && !strings.HasPrefix(title, ".") {
+			continue
+		}
+		folder := &Folder{Remote: RemoteName(title, delim, cfg.Layout), Direction: DirectionBoth}
+		// discovery would give the mailbox another local name
+		if LocalName(folder.Remote, delim, cfg.Layout) != title {
+			fmt.Fprintf(os.Stderr, "local folder %s is not synced (%s would come back as %s)\n", title, folder.Remote, LocalName(folder.Remote, delim, cfg.Layout))
+			continue
+		}
+		if cfg.CreatePolicy == CreateNotify {
+			fmt.Fprintf(os.Stderr, "local folder %s is not synced (would be %s)\n", title, folder.Remote)
+			continue
+		}
+		if !exists[folder.Remote] {
+			if e := createMailbox(c, folder); refused(e, folder.Remote) {
+				continue
+			} else if e != nil {
+				return nil, e
+			}
+		}
+		folder_list[title] = folder
+		active[title] = folder
+	}
+	return active, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-maildir"
+)
+
+// Gmail extensions, see https://developers.google.com/gmail/imap/imap-extensions
+const (
+	FetchGmailLabels imap.FetchItem = "X-GM-LABELS"
+	FetchGmailMsgId  imap.FetchItem = "X-GM-MSGID"
+)
+
+// gmailLabels returns the X-GM-LABELS of msg.
+func gmailLabels(msg *imap.Message) []string {
+	if raw, ok := msg.Items[FetchGmailLabels].([]interface{}); ok {
+		if labels, e := imap.ParseStringList(raw); e == nil {
+			return labels
+		}
+	}
+	return nil
+}
+
+// gmailMsgId returns the X-GM-MSGID of msg, which stays the same across labels and folders.
+func gmailMsgId(msg *imap.Message) string {
+	if raw, ok := msg.Items[FetchGmailMsgId]; ok && raw != nil {
+		return fmt.Sprint(raw)
+	}
+	return ""
+}
+
+// gmailFlags returns the system flags of msg plus its labels as keyword letters.
+func gmailFlags(msg *imap.Message, kw *Keywords) []maildir.Flag {
+	fl := parseFlags(msg.Flags, nil)
+	for _, label := range gmailLabels(msg) {
+		if f, ok := kw.Flag(label); ok {
+			fl = append(fl, f)
+		}
+	}
+	return fl
+}
+
+// splitLabels separates merged maildir flags into IMAP flags and Gmail labels.
+func splitLabels(in_flags []maildir.Flag, kw *Keywords) (flags []interface{}, labels []interface{}) {
+	flags = deparseFlags(in_flags, nil)
+	for _, f := range in_flags {
+		if label, ok := kw.Keyword(f); ok {
+			labels = append(labels, label)
+		}
+	}
+	return
+}
+
+// StoreLabels adds labels to the messages in seq (UIDs when uid is set).
+func StoreLabels(c *client.Client, seq *imap.SeqSet, uid bool, labels []interface{}) error {
+	var cmd imap.Commander = &commands.Store{
+		SeqSet: seq,
+		Item:   imap.StoreItem("+X-GM-LABELS.SILENT"),
+		Value:  labels,
+	}
+	if uid {
+		cmd = &commands.Uid{Cmd: cmd}
+	}
+	status, e := c.Execute(cmd, nil)
+	if e != nil {
+		return e
+	}
+	return statusErr(status)
+}
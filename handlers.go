@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net/mail"
 	"os"
 	"path/filepath"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -15,25 +16,62 @@ import (
 	"github.com/emersion/go-maildir"
 )
 
-func DownloadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox) error {
+// DownloadHandler fetches new remote messages into D, syncs flags and deletes local
+// messages which are gone on the server, as far as folder.Direction allows.
+func DownloadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox, folder *Folder, kw *Keywords) error {
 	section := &imap.BodySectionName{Peek: true}
-	uid_items, fetch_items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, section.FetchItem()}
-	uid_chan, fetch_chan := make(chan *imap.Message, 10), make(chan *imap.Message, 10)
-	uid_seq, fetch_seq := new(imap.SeqSet), new(imap.SeqSet)
-	uid_done, fetch_done := make(chan error, 1), make(chan error, 1)
-	if p, e := c.Status(mbox.Name, []imap.StatusItem{imap.StatusMessages}); e == nil {
+	uid_items, fetch_items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, imap.FetchInternalDate}, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchRFC822Size, imap.FetchInternalDate}
+	if folder.Labels {
+		uid_items = append(uid_items, FetchGmailLabels)
+		fetch_items = append(fetch_items, FetchGmailLabels, FetchGmailMsgId)
+	}
+	uid_chan := make(chan *imap.Message, 10)
+	uid_seq, fetch_seq, header_seq := new(imap.SeqSet), new(imap.SeqSet), new(imap.SeqSet)
+	var offline_uids []uint32
+	uid_done := make(chan error, 1)
+	if folder.Direction == DirectionPull {
+		// mirror: anything removed locally is downloaded again
+		keys, e := D.Keys()
+		if e != nil {
+			return e
+		}
+		on_disk := make(map[string]bool)
+		for _, k := range keys {
+			on_disk[k] = true
+		}
+		for uid, key := range mem.Keys {
+			if !on_disk[key] {
+				delete(mem.Keys, uid)
+				delete(mem.Info, uid)
+			}
+		}
+	}
+	// the selected mailbox is kept up to date by the EXISTS responses
+	if e := c.Noop(); e == nil {
+		p := c.Mailbox()
+		mem.UidNext, mem.Messages = mbox.UidNext, p.Messages
 		if p.Messages > 0 {
 			uid_seq.AddRange(1, p.Messages)
+		} else if folder.Direction == DirectionPush {
+			return nil
 		} else {
 			// no messages to fetch
 			var anything bool
 			for uid, key := range mem.Keys {
 				anything = true
 				delete(mem.Keys, uid)
+				delete(mem.Info, uid)
 				if e := D.Remove(key); e != nil {
 					return e
 				}
 			}
+			for uid, key := range mem.Quarantine {
+				delete(mem.Quarantine, uid)
+				maildir.Dir(folder.quarantine).Remove(key)
+			}
+			for uid := range mem.Window {
+				delete(mem.Window, uid)
+			}
 			if anything {
 				fmt.Fprintf(os.Stderr, "deleting all local messages from %s\n", mbox.Name)
 			}
@@ -42,102 +80,407 @@ func DownloadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus,
 	} else {
 		return e
 	}
+	window, e := applyWindow(c, D, mbox, mem, folder)
+	if e != nil {
+		return e
+	}
 	go func() {
-		uid_done <- c.Fetch(uid_seq, uid_items, uid_chan)
+		if window == nil {
+			uid_done <- c.Fetch(uid_seq, uid_items, uid_chan)
+		} else if window.Empty() {
+			close(uid_chan)
+			uid_done <- nil
+		} else {
+			uid_done <- c.UidFetch(window, uid_items, uid_chan)
+		}
 	}()
 	remote_uids := make(map[uint32]bool)
 
-	// sync flags
-	fchan := make(chan *FlagUpdateRequest)
-	var wg sync.WaitGroup
-	go func() {
-		for f := range fchan {
-			tmp := new(imap.SeqSet)
-			tmp.AddNum(f.uid)
-			if e := c.Store(tmp, imap.FormatFlagsOp(imap.AddFlags, true), f.flags, nil); e != nil {
-				panic(e)
-			}
-		}
-	}()
+	// sync flags, pushes are collected and sent once the FETCH is done
+	pushes := make(FlagPushes)
+	keep := NewStorable(mbox)
 	for msg := range uid_chan {
 		remote_uids[msg.Uid] = true
-		if key, ok := mem.Keys[msg.Uid]; ok == true {
+		if msg.Uid >= mem.UidNext {
+			// appended since the SELECT
+			mem.UidNext = msg.Uid + 1
+		}
+		if _, ok := mem.Quarantine[msg.Uid]; ok {
+			continue
+		} else if key, ok := mem.Keys[msg.Uid]; ok == true {
 			// have the message in memory. sync flags
-			if f, e := SyncFlags(key, D, msg.Flags); e != nil && f != nil {
-				wg.Add(1)
-				go func(seqnum uint32, f []interface{}) {
-					defer wg.Done()
-					// send a FlagUpdateRequest
-					fchan <- &FlagUpdateRequest{seqnum, f}
-				}(msg.SeqNum, f)
+			// a message deleted locally since the upload is taken care of by the next sync
+			if folder.Labels {
+				// labels are synced like keywords
+				if fl, e := syncFlags(key, D, gmailFlags(msg, kw), folder.Direction, kw, keep); e != nil && !isMissing(e) {
+					return e
+				} else if fl != nil {
+					flags, labels := splitLabels(fl, kw)
+					pushes.Add(msg.Uid, flags, labels)
+				}
+			} else if f, e := SyncFlags(key, D, msg.Flags, folder.Direction, kw, keep); e != nil && !isMissing(e) {
+				return e
+			} else if f != nil {
+				pushes.Add(msg.Uid, f, nil)
 			}
-		} else {
+		} else if folder.Direction != DirectionPush {
 			// don't have in memory, need to fetch
-			fetch_seq.AddNum(msg.Uid)
+			switch action := folder.DownloadSize.Decide(int64(msg.Size)); action {
+			case SizeSync:
+				if folder.HeadersOlderThan > 0 && msg.InternalDate.Before(time.Now().AddDate(0, 0, -folder.HeadersOlderThan)) {
+					header_seq.AddNum(msg.Uid)
+				} else {
+					fetch_seq.AddNum(msg.Uid)
+				}
+			case SizeHeaders:
+				fmt.Fprintf(os.Stderr, "%d in %s is %d bytes: %s\n", msg.Uid, mbox.Name, msg.Size, action)
+				header_seq.AddNum(msg.Uid)
+			case SizeOffline:
+				fmt.Fprintf(os.Stderr, "%d in %s is %d bytes: %s\n", msg.Uid, mbox.Name, msg.Size, action)
+				offline_uids = append(offline_uids, msg.Uid)
+			default:
+				fmt.Fprintf(os.Stderr, "%d in %s is %d bytes: %s\n", msg.Uid, mbox.Name, msg.Size, action)
+			}
 		}
 	}
 	if e := <-uid_done; e != nil {
 		return e
 	}
-	wg.Wait()
-	close(fchan)
+	if e := pushes.Store(c); e != nil {
+		return e
+	}
 
 	// delete the ones not in remote
+	// (push keeps them in memory as well, so they are not uploaded again)
 	ldel_seq := new(imap.SeqSet)
 	for uid, key := range mem.Keys {
-		if remote_uids[uid] == false {
+		if remote_uids[uid] == false && folder.Direction != DirectionPush {
 			ldel_seq.AddNum(uid)
 			if e := D.Remove(key); e == nil {
 				delete(mem.Keys, uid)
+				delete(mem.Info, uid)
 			}
 		}
 	}
 	if !ldel_seq.Empty() {
 		fmt.Fprintf(os.Stderr, "deleting %s from local %s\n", ldel_seq.String(), mbox.Name)
 	}
-	if fetch_seq.Empty() {
+	for uid, key := range mem.Quarantine {
+		if !remote_uids[uid] {
+			delete(mem.Quarantine, uid)
+			maildir.Dir(folder.quarantine).Remove(key)
+		}
+	}
+	if e := fetchMessages(c, D, mbox, mem, folder, kw, fetch_seq, section, fetch_items, false); e != nil {
+		return e
+	}
+	// one at a time, the client keeps each message in memory until it is read
+	for _, uid := range offline_uids {
+		seq := new(imap.SeqSet)
+		seq.AddNum(uid)
+		if e := fetchMessages(c, D, mbox, mem, folder, kw, seq, section, fetch_items, true); e != nil {
+			return e
+		}
+	}
+	header_section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier}, Peek: true}
+	return fetchMessages(c, D, mbox, mem, folder, kw, header_seq, header_section, fetch_items, false)
+}
+
+// fetchMessages downloads the messages in seq (UIDs) into D; section is the part stored
+// (fetched along with items), anything short of the whole message is marked as partial.
+// With offline the messages go to the offline archive and D only gets a stub.
+func fetchMessages(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox, folder *Folder, kw *Keywords, seq *imap.SeqSet, section *imap.BodySectionName, items []imap.FetchItem, offline bool) error {
+	if seq.Empty() {
 		return nil
 	}
-	fmt.Fprintf(os.Stderr, "downloading %s to local %s\n", fetch_seq.String(), mbox.Name)
+	partial := section.Specifier != imap.EntireSpecifier || offline
+	if offline {
+		fmt.Fprintf(os.Stderr, "archiving %s from %s to %s\n", seq.String(), mbox.Name, folder.offline)
+	} else if partial {
+		fmt.Fprintf(os.Stderr, "downloading headers of %s to local %s\n", seq.String(), mbox.Name)
+	} else {
+		fmt.Fprintf(os.Stderr, "downloading %s to local %s\n", seq.String(), mbox.Name)
+	}
+	items = append(items[:len(items):len(items)], section.FetchItem())
+	fetch_chan, fetch_done := make(chan *imap.Message, 10), make(chan error, 1)
 	go func() {
-		fetch_done <- c.UidFetch(fetch_seq, fetch_items, fetch_chan)
+		fetch_done <- c.UidFetch(seq, items, fetch_chan)
 	}()
 
 	buffer := new(bufio.Reader)
 	for msg := range fetch_chan {
-		fl := parseFlags(msg.Flags)
+		fl := parseFlags(msg.Flags, kw)
+		if folder.Labels {
+			fl = gmailFlags(msg, kw)
+		}
+		body := msg.GetBody(section)
+		if body == nil {
+			return fmt.Errorf("no body for %d in %s", msg.Uid, mbox.Name)
+		}
+		var archived string
+		policy := folder.headerPolicy(false)
+		if offline {
+			header := new(headerBuffer)
+			var e error
+			if archived, e = write_to_archive(folder.offline, io.TeeReader(body, header)); e != nil {
+				return e
+			}
+			body, policy = bytes.NewReader(offlineStub(header.Bytes(), archived, msg.Size)), nil
+		}
+		// the headers have to be parsed for the policy, messages which fail are quarantined
+		var parsed *mail.Message
+		if policy != nil {
+			raw, e := io.ReadAll(body)
+			if e != nil {
+				return e
+			}
+			if parsed, e = parseMessage(raw, msg.InternalDate); e != nil {
+				if e := quarantine(maildir.Dir(folder.quarantine), mem, msg.Uid, fl, raw); e != nil {
+					return e
+				}
+				fmt.Fprintf(os.Stderr, "quarantined %d from %s: %s\n", msg.Uid, mbox.Name, e)
+				continue
+			}
+		}
 		k, f, e := D.Create(fl)
 		mem.Keys[msg.Uid] = k
 		if e != nil {
 			return e
 		}
 
-		if msg, e := mail.ReadMessage(msg.GetBody(section)); e != nil {
-			return e
-		} else {
-			if _, e = msg.Header.Date(); e != nil {
+		if policy == nil {
+			if _, e := CopyMessage(f, body, folder.LineEndings); e != nil {
 				return e
 			}
-			buffer.Reset(msg.Body)
-			if _, e := WriteMessage(msg.Header, buffer, f); e != nil {
+		} else {
+			buffer.Reset(parsed.Body)
+			if _, e := WriteMessage(policy.Apply(parsed.Header, folder.vars), buffer, f); e != nil {
 				panic(e)
 			}
 		}
 		if e := f.Close(); e != nil {
 			return e
 		}
+		if info, e := messageInfo(D, k); e == nil {
+			info.Size = msg.Size
+			info.GmailId = gmailMsgId(msg)
+			info.Partial = partial
+			info.Offline = archived
+			mem.Info[msg.Uid] = info
+		}
 	}
 	return <-fetch_done
 }
 
-func UploadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox, microsoftp bool, limit int64) error {
-	rb := new(bufio.Reader)
+// the headers of a stub left by SizeOffline, the body is replaced by a note
+var stub_policy = &HeaderPolicy{
+	Mode:  HeaderDeny,
+	Names: []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Id", "Content-Description", "Content-Length"},
+	Add: map[string]string{
+		"Content-Type":      "text/plain; charset=us-ascii",
+		"X-Offline-Archive": "{archive}",
+	},
+}
+
+// offlineStub returns the stub for the message with the header raw, which is stored in the
+// offline archive as name.
+func offlineStub(raw []byte, name string, size uint32) []byte {
+	header := make(mail.Header)
+	if msg, e := mail.ReadMessage(bytes.NewReader(raw)); e == nil {
+		header = msg.Header
+	}
+	note := fmt.Sprintf("This message (%d bytes) is kept in the offline archive as %s.\n", size, name)
+	stub := new(bytes.Buffer)
+	WriteMessage(stub_policy.Apply(header, map[string]string{"{archive}": name}), bufio.NewReader(strings.NewReader(note)), stub)
+	return stub.Bytes()
+}
+
+// headerBuffer keeps what is written to it up to the end of the message header.
+type headerBuffer struct {
+	bytes.Buffer
+	done bool
+}
+
+func (h *headerBuffer) Write(p []byte) (int, error) {
+	if !h.done {
+		h.Buffer.Write(p)
+		end := -1
+		if i := bytes.Index(h.Bytes(), []byte("\n\n")); i >= 0 {
+			end = i + 2
+		}
+		if i := bytes.Index(h.Bytes(), []byte("\n\r\n")); i >= 0 && (end < 0 || i+3 < end) {
+			end = i + 3
+		}
+		if end >= 0 {
+			h.Truncate(end)
+			h.done = true
+		}
+	}
+	return len(p), nil
+}
+
+// parseMessage parses raw for the header policy. A missing Date is filled in
+// from internal_date (INTERNALDATE), a broken one is an error.
+func parseMessage(raw []byte, internal_date time.Time) (*mail.Message, error) {
+	msg, e := mail.ReadMessage(bytes.NewReader(raw))
+	if e != nil {
+		return nil, e
+	}
+	if _, e := msg.Header.Date(); e == mail.ErrHeaderNotPresent && !internal_date.IsZero() {
+		msg.Header["Date"] = []string{internal_date.Format(time.RFC1123Z)}
+	} else if e != nil {
+		return nil, e
+	}
+	return msg, nil
+}
+
+// quarantine stores raw as it is in Q and records it under uid.
+func quarantine(Q maildir.Dir, mem *MemoryMailbox, uid uint32, flags []maildir.Flag, raw []byte) error {
+	if e := os.MkdirAll(filepath.Dir(string(Q)), os.ModePerm); e != nil {
+		return e
+	} else if e := Q.Init(); e != nil {
+		return e
+	}
+	k, f, e := Q.Create(flags)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write(raw); e != nil {
+		f.Close()
+		return e
+	} else if e := f.Close(); e != nil {
+		return e
+	}
+	mem.Quarantine[uid] = k
+	return nil
+}
+
+// uploads are sent in batches of at most this many messages or bytes
+const upload_batch = 50
+const upload_batch_bytes = 8 << 20
+
+type pendingUpload struct {
+	key      string
+	open     func() (io.ReadCloser, error)
+	flag_err error
+	// Gmail labels, set after the APPEND
+	labels []interface{}
+	req    *AppendRequest
+}
+
+// messageSource returns a function opening the message key as it is uploaded:
+// the file itself, or with policy applied to its headers.
+func messageSource(D maildir.Dir, key string, policy *HeaderPolicy, vars map[string]string) func() (io.ReadCloser, error) {
+	if policy == nil {
+		return func() (io.ReadCloser, error) {
+			return D.Open(key)
+		}
+	}
+	return func() (io.ReadCloser, error) {
+		f, e := D.Open(key)
+		if e != nil {
+			return nil, e
+		}
+		r, w := io.Pipe()
+		go func() {
+			defer f.Close()
+			msg, e := mail.ReadMessage(f)
+			if e == nil {
+				_, e = WriteMessage(policy.Apply(msg.Header, vars), bufio.NewReader(msg.Body), w)
+			}
+			w.CloseWithError(e)
+		}()
+		return r, nil
+	}
+}
+
+func UploadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox, folder *Folder, kw *Keywords) error {
 	not_to_delete := make(map[string]bool)
+	new_uids := new(imap.SeqSet)
+	var pending []*pendingUpload
+	var pending_bytes int
+	// flush appends the pending batch and records the UIDs the server handed out
+	flush := func() error {
+		reqs := make([]*AppendRequest, len(pending))
+		for i, p := range pending {
+			reqs[i] = p.req
+		}
+		e := AppendBatch(c, mbox.Name, reqs)
+		for _, p := range pending {
+			p.req.Message.(*StreamLiteral).Close()
+		}
+		if e != nil {
+			return e
+		}
+		// labels cannot be given to APPEND
+		pushes := make(FlagPushes)
+		for _, p := range pending {
+			if p.req.Err == nil && p.req.Uid != 0 && len(p.labels) > 0 {
+				pushes.Add(p.req.Uid, nil, p.labels)
+			}
+		}
+		if e := pushes.Store(c); e != nil {
+			if _, refused := e.(*RefusedError); !refused {
+				return e
+			}
+			fmt.Fprintf(os.Stderr, "(labels refused: %s) ", e)
+		}
+		for _, p := range pending {
+			if p.req.Err != nil {
+				// leave the local file alone, it is retried on the next sync
+				fmt.Fprintf(os.Stderr, "(%s refused: %s) ", p.key, p.req.Err)
+				continue
+			} else if p.req.Uid == 0 && folder.Direction == DirectionPush {
+				// never downloaded again, keep it
+				fmt.Fprintf(os.Stderr, "(unknown uid for %s, kept) ", p.key)
+				mem.Pending[p.key] = true
+				continue
+			} else if p.req.Uid == 0 {
+				// the message will be picked up by the next download
+				fmt.Fprintf(os.Stderr, "(unknown uid for %s) ", p.key)
+			} else if p.flag_err == nil {
+				if nukey, e := D.Copy(D, p.key); e == nil {
+					mem.Keys[p.req.Uid] = nukey
+					if info, e := messageInfo(D, nukey); e == nil {
+						mem.Info[p.req.Uid] = info
+					}
+					not_to_delete[nukey] = true
+					new_uids.AddNum(p.req.Uid)
+				} else {
+					return e
+				}
+			} else if nukey, w, e := D.Create(nil); e == nil {
+				mem.Keys[p.req.Uid] = nukey
+				not_to_delete[nukey] = true
+				new_uids.AddNum(p.req.Uid)
+				if r, e := p.open(); e != nil {
+					return e
+				} else if _, e := io.Copy(w, r); e != nil {
+					r.Close()
+					return e
+				} else {
+					r.Close()
+				}
+				w.Close()
+				if info, e := messageInfo(D, nukey); e == nil {
+					mem.Info[p.req.Uid] = info
+				}
+			} else {
+				return e
+			}
+			if e := D.Remove(p.key); e != nil {
+				return e
+			}
+		}
+		pending, pending_bytes = nil, 0
+		return nil
+	}
 	if keys, e := D.Keys(); e == nil {
-		new_uids := new(imap.SeqSet)
 		var first bool = true
+		on_disk := make(map[string]bool)
 	OUTER:
 		for _, key := range keys {
+			on_disk[key] = true
 			for _, k := range mem.Keys {
 				if k == key {
 					// key is in memory and also exists in directory
@@ -145,91 +488,97 @@ func UploadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, me
 					continue OUTER
 				}
 			}
+			if mem.Pending[key] {
+				continue
+			}
 			// key is not in memory
-			var nuid uint32
 			if first {
 				fmt.Fprintf(os.Stderr, "uploading to %s ", mbox.Name)
 				first = false
 			}
-			// microsoft has a bug...
-			if microsoftp {
-				if m, e := c.Select(mbox.Name, false); e == nil {
-					nuid = m.UidNext
-					mbox = m
-				} else {
-					return e
-				}
-			} else {
-				if stat, e := c.Status(mbox.Name, []imap.StatusItem{imap.StatusUidNext}); e == nil {
-					nuid = stat.UidNext
-				} else {
-					return e
-				}
-			}
 			var date time.Time
-			var toobig bool
-			buf := bytes.NewBuffer(nil)
+			var message_id string
 			if s, e := D.Filename(key); e != nil {
 				return e
 			} else if info, e := os.Stat(s); e != nil {
 				return e
-			} else if info.Size() > limit {
-				toobig = true
-			} else if f, e := D.Open(key); e != nil {
-				return e
-			} else {
-				if msg, e := mail.ReadMessage(f); e != nil {
+			} else if action := folder.UploadSize.Decide(info.Size()); action != SizeSync {
+				fmt.Fprintf(os.Stderr, "(%s is %d bytes: %s) ", key, info.Size(), action)
+				if action == SizeSkip {
+					continue
+				} else if f, e := os.Open(s); e != nil {
+					return e
+				} else if e := save_to_archive(folder.offline, f, s); e != nil {
+					f.Close()
 					return e
 				} else {
-					date, e = msg.Header.Date()
-					if e != nil {
-						return e
-					}
-					rb.Reset(msg.Body)
-					if _, e := WriteMessage(msg.Header, rb, buf); e != nil {
-						panic(e)
-					}
+					f.Close()
 				}
+				continue
+			} else if f, e := D.Open(key); e != nil {
+				return e
+			} else {
+				// only the headers are read here, the message is streamed by the APPEND
+				msg, e := mail.ReadMessage(f)
 				f.Close()
-			}
-			if toobig {
-				if s, e := D.Filename(key); e != nil {
-					return e
-				} else if e := save_to_archive(filepath.Join(filepath.Dir(string(D)), "offline"), buf, s); e != nil {
-					return e
+				if e != nil {
+					fmt.Fprintf(os.Stderr, "(cannot parse %s, skipping: %s) ", key, e)
+					continue
 				}
-			} else {
-				var fl []string
-				if tfl, e := D.Flags(key); e == nil {
-					ttfl := deparseFlags(tfl)
-					for _, i := range ttfl {
-						fl = append(fl, i.(string))
-					}
-					if nukey, e := D.Copy(D, key); e == nil {
-						mem.Keys[nuid] = nukey
-						not_to_delete[nukey] = true
-						new_uids.AddNum(nuid)
-					} else {
-						return e
-					}
-				} else if nukey, w, e := D.Create(nil); e == nil {
-					mem.Keys[nuid] = nukey
-					not_to_delete[nukey] = true
-					new_uids.AddNum(nuid)
-					if _, e := w.Write(buf.Bytes()); e != nil {
-						return e
-					}
+				// the APPEND date is optional, the server uses the time of arrival
+				if date, e = msg.Header.Date(); e != nil {
+					date = time.Time{}
 				}
-				if e := c.Append(mbox.Name, fl, date, buf); e != nil {
-					return e
+				message_id = msg.Header.Get("Message-Id")
+			}
+			var fl []string
+			var labels []interface{}
+			tfl, flag_err := D.Flags(key)
+			if flag_err == nil {
+				flags := deparseFlags(tfl, kw)
+				if folder.Labels {
+					flags, labels = splitLabels(tfl, kw)
 				}
-				if e := D.Remove(key); e != nil {
+				flags = pushableFlags(c, flags)
+				for _, i := range flags {
+					fl = append(fl, i.(string))
+				}
+			}
+			open := messageSource(D, key, folder.headerPolicy(true), folder.vars)
+			literal, e := NewStreamLiteral(open)
+			if e != nil {
+				return e
+			}
+			pending = append(pending, &pendingUpload{
+				key:      key,
+				open:     open,
+				flag_err: flag_err,
+				labels:   labels,
+				req: &AppendRequest{
+					Flags:     fl,
+					Date:      date,
+					Message:   literal,
+					MessageId: message_id,
+				},
+			})
+			if pending_bytes += literal.Len(); len(pending) >= upload_batch || pending_bytes >= upload_batch_bytes {
+				if e := flush(); e != nil {
 					return e
 				}
 			}
 		}
+		if e := flush(); e != nil {
+			return e
+		}
+		for key := range mem.Pending {
+			if !on_disk[key] {
+				delete(mem.Pending, key)
+			}
+		}
 		if !new_uids.Empty() {
 			fmt.Fprintf(os.Stderr, "%s to %s\n", new_uids.String(), mbox.Name)
+		} else if !first {
+			fmt.Fprintf(os.Stderr, "\n")
 		}
 	} else {
 		return e
@@ -240,6 +589,7 @@ func UploadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, me
 		if not_to_delete[key] == false {
 			delete_seq.AddNum(uid)
 			delete(mem.Keys, uid)
+			delete(mem.Info, uid)
 		}
 	}
 	if !delete_seq.Empty() {
@@ -247,7 +597,7 @@ func UploadHandler(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, me
 		flags := []interface{}{imap.DeletedFlag}
 		fmt.Fprintf(os.Stderr, "deleting %s from remote %s\n", delete_seq.String(), mbox.Name)
 		c.UidStore(delete_seq, item, flags, nil)
-		if err := c.Expunge(nil); err != nil {
+		if err := expungeUids(c, delete_seq); err != nil {
 			panic(err)
 		}
 	}
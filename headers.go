@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// keep only the listed headers
+	HeaderAllow = "allow"
+	// keep everything but the listed headers
+	HeaderDeny = "deny"
+)
+
+// HeaderPolicy decides which headers a message keeps when it is stored locally or uploaded.
+type HeaderPolicy struct {
+	// HeaderAllow or HeaderDeny
+	Mode string `json:"mode"`
+	// header names
+	Names []string `json:"names"`
+	// regular expressions matched against the (canonical) header name
+	Patterns []string `json:"patterns"`
+	// headers to add (replacing any existing ones); the values may contain
+	// {folder}, {remote} and {server}
+	Add map[string]string `json:"add"`
+
+	patterns []*regexp.Regexp
+}
+
+// the policy of StorageFiltered
+var filtered_policy = &HeaderPolicy{Mode: HeaderAllow, Names: header_list}
+
+// HeaderField is a single header line.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Compile checks the policy and compiles its patterns.
+func (p *HeaderPolicy) Compile() error {
+	switch p.Mode {
+	case HeaderAllow, HeaderDeny:
+	default:
+		return fmt.Errorf("unknown header mode %q", p.Mode)
+	}
+	p.patterns = nil
+	for _, pattern := range p.Patterns {
+		if re, e := regexp.Compile(pattern); e != nil {
+			return e
+		} else {
+			p.patterns = append(p.patterns, re)
+		}
+	}
+	return nil
+}
+
+// listed reports whether the header name is matched by Names or Patterns.
+func (p *HeaderPolicy) listed(name string) bool {
+	for _, n := range p.Names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the headers to write: the kept headers of h, Names first and the rest
+// sorted by name, followed by the added ones. vars fills in the placeholders of Add.
+func (p *HeaderPolicy) Apply(h mail.Header, vars map[string]string) (fields []HeaderField) {
+	var names []string
+	seen := make(map[string]bool)
+	if p.Mode == HeaderAllow {
+		for _, n := range p.Names {
+			names = append(names, textproto.CanonicalMIMEHeaderKey(n))
+			seen[textproto.CanonicalMIMEHeaderKey(n)] = true
+		}
+	}
+	var rest []string
+	for name := range h {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	for _, name := range names {
+		if p.listed(name) != (p.Mode == HeaderAllow) {
+			continue
+		} else if _, replaced := p.Add[name]; replaced {
+			continue
+		}
+		// every instance, e.g. Received
+		for _, v := range h[name] {
+			if v != "" {
+				fields = append(fields, HeaderField{name, v})
+			}
+		}
+	}
+	var added []string
+	for name := range p.Add {
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		v := p.Add[name]
+		for k, r := range vars {
+			v = strings.ReplaceAll(v, k, r)
+		}
+		fields = append(fields, HeaderField{name, v})
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-maildir"
+)
+
+// Keywords maps IMAP keywords ($Label1, $Junk, project tags, ...) to the lowercase maildir
+// flags a-z. The table is kept in the dovecot-keywords file of the maildir, where the line
+// "0 $Label1" means that $Label1 is stored as flag a, so MUAs reading that file agree.
+type Keywords struct {
+	filename string
+	names    [26]string
+	changed  bool
+	// keywords which found no free letter, logged once
+	dropped map[string]bool
+}
+
+// LoadKeywords reads the keyword table of D, an absent file is an empty table.
+func LoadKeywords(D maildir.Dir) (*Keywords, error) {
+	kw := &Keywords{filename: filepath.Join(string(D), "dovecot-keywords")}
+	f, e := os.Open(kw.filename)
+	if os.IsNotExist(e) {
+		return kw, nil
+	} else if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if i, e := strconv.Atoi(fields[0]); e == nil && i >= 0 && i < len(kw.names) {
+			kw.names[i] = fields[1]
+		}
+	}
+	return kw, scanner.Err()
+}
+
+// Flag returns the maildir flag for keyword, taking the next free letter for new keywords.
+// ok is false when all 26 letters are taken; the keyword is then dropped locally.
+func (kw *Keywords) Flag(keyword string) (f maildir.Flag, ok bool) {
+	free := -1
+	for i, name := range kw.names {
+		if strings.EqualFold(name, keyword) {
+			return maildir.Flag('a' + i), true
+		} else if name == "" && free < 0 {
+			free = i
+		}
+	}
+	if free < 0 {
+		if !kw.dropped[keyword] {
+			if kw.dropped == nil {
+				kw.dropped = make(map[string]bool)
+			}
+			kw.dropped[keyword] = true
+			fmt.Fprintf(os.Stderr, "(no flag letter left for %s in %s, dropped) ", keyword, kw.filename)
+		}
+		return 0, false
+	}
+	kw.names[free] = keyword
+	kw.changed = true
+	return maildir.Flag('a' + free), true
+}
+
+// Keyword returns the keyword stored as flag f.
+func (kw *Keywords) Keyword(f maildir.Flag) (string, bool) {
+	if kw == nil || f < 'a' || f > 'z' || kw.names[f-'a'] == "" {
+		return "", false
+	}
+	return kw.names[f-'a'], true
+}
+
+// Save writes the table back if new keywords were added.
+func (kw *Keywords) Save() error {
+	if !kw.changed {
+		return nil
+	}
+	f, e := os.Create(kw.filename)
+	if e != nil {
+		return e
+	}
+	for i, name := range kw.names {
+		if name != "" {
+			fmt.Fprintf(f, "%d %s\n", i, name)
+		}
+	}
+	kw.changed = false
+	return f.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// "Projects/Alpha" is stored in the directory Projects/Alpha
+	LayoutNested = "nested"
+	// "Projects/Alpha" is stored in the directory .Projects.Alpha
+	LayoutMaildirPP = "maildir++"
+)
+
+// escapeComponent makes one level of a mailbox name usable as (part of) a file name.
+// Unsafe bytes are written as %XX, so that unescapeComponent can undo it.
+// In the nested layout cur, new and tmp would land in the parent's maildir directories,
+// so their first letter is escaped as well.
+func escapeComponent(s string, layout string) string {
+	var b strings.Builder
+	if layout != LayoutMaildirPP && (s == "cur" || s == "new" || s == "tmp") {
+		fmt.Fprintf(&b, "%%%02X", s[0])
+		s = s[1:]
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '%', ch == '/', ch == '\\', ch < 0x20, ch == 0x7f,
+			ch == '.' && (layout == LayoutMaildirPP || i == 0):
+			fmt.Fprintf(&b, "%%%02X", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+func unescapeComponent(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			var ch byte
+			if _, e := fmt.Sscanf(s[i+1:i+3], "%02X", &ch); e == nil {
+				b.WriteByte(ch)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// LocalName maps the remote mailbox name (with hierarchy delimiter delim) to a local folder name.
+func LocalName(remote string, delim string, layout string) string {
+	parts := []string{remote}
+	if delim != "" {
+		parts = strings.Split(remote, delim)
+	}
+	for i := range parts {
+		parts[i] = escapeComponent(parts[i], layout)
+	}
+	if layout == LayoutMaildirPP {
+		return "." + strings.Join(parts, ".")
+	}
+	return filepath.Join(parts...)
+}
+
+// RemoteName is the inverse of LocalName.
+func RemoteName(local string, delim string, layout string) string {
+	var parts []string
+	if layout == LayoutMaildirPP {
+		parts = strings.Split(strings.TrimPrefix(local, "."), ".")
+	} else {
+		parts = strings.Split(filepath.ToSlash(local), "/")
+	}
+	for i := range parts {
+		parts[i] = unescapeComponent(parts[i])
+	}
+	if delim == "" {
+		return strings.Join(parts, "")
+	}
+	return strings.Join(parts, delim)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestLocalName(t *testing.T) {
+	tests := []struct {
+		remote, delim, layout, local string
+	}{
+		{"INBOX", "/", LayoutNested, "INBOX"},
+		{"Projects/Alpha", "/", LayoutNested, "Projects/Alpha"},
+		{"Projects.Alpha", ".", LayoutNested, "Projects/Alpha"},
+		{"Projects/Alpha", "/", LayoutMaildirPP, ".Projects.Alpha"},
+		{"v1.2/notes", "/", LayoutMaildirPP, ".v1%2E2.notes"},
+		{"v1.2/notes", "/", LayoutNested, "v1.2/notes"},
+		{".hidden", "/", LayoutNested, "%2Ehidden"},
+		{"a\\b/50%", "/", LayoutNested, "a%5Cb/50%25"},
+		{"Projects/new", "/", LayoutNested, "Projects/%6Eew"},
+		{"cur/tmp", "/", LayoutNested, "%63ur/%74mp"},
+		{"Projects/new", "/", LayoutMaildirPP, ".Projects.new"},
+		{"newer/cure", "/", LayoutNested, "newer/cure"},
+		{"a/b", "", LayoutNested, "a%2Fb"},
+	}
+	for _, tt := range tests {
+		if got := LocalName(tt.remote, tt.delim, tt.layout); got != tt.local {
+			t.Errorf("LocalName(%q, %q, %q) = %q, want %q", tt.remote, tt.delim, tt.layout, got, tt.local)
+		}
+		if got := RemoteName(tt.local, tt.delim, tt.layout); got != tt.remote {
+			t.Errorf("RemoteName(%q, %q, %q) = %q, want %q", tt.local, tt.delim, tt.layout, got, tt.remote)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,12 +18,16 @@ import (
 	maildir "github.com/emersion/go-maildir"
 )
 
+// how often watched folders besides the IDLE one are checked
+const poll_interval = 5 * time.Minute
+
 func main() {
 	flag.Parse()
-	addr, a, folder_list, directory, mem, e := LoadConfig(os.Stdin)
+	cfg, a, folder_list, mem, e := LoadConfig(os.Stdin)
 	if e != nil {
 		panic(e)
 	}
+	directory := cfg.Directory
 	if *archive_flag {
 		s := filepath.Join(directory, "archive")
 		t := filepath.Join(directory, "offline")
@@ -36,7 +42,15 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if *fetch_flag != "" {
+		if e := requestFetch(directory, *fetch_flag); e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	socket_chan := make(chan struct{})
+	fetch_requests := make(chan *FetchRequest, 16)
 	go func() {
 		sock_addr := filepath.Join(directory, ".socket")
 		if e := os.RemoveAll(sock_addr); e != nil {
@@ -48,6 +62,18 @@ func main() {
 		}
 		defer l.Close()
 		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fetch" {
+				// completed by the sync loop after the next sync
+				req := &FetchRequest{Id: r.URL.Query().Get("id"), Done: make(chan error, 1)}
+				fetch_requests <- req
+				socket_chan <- struct{}{}
+				if e := <-req.Done; e != nil {
+					http.Error(w, e.Error(), http.StatusNotFound)
+				} else {
+					fmt.Fprintln(w, "fetched", req.Id)
+				}
+				return
+			}
 			fmt.Fprintln(w, "signal received")
 			socket_chan <- struct{}{}
 		}
@@ -68,7 +94,7 @@ func main() {
 		// can exit by calling return
 		func() {
 			var kill_signal, timed_out bool
-			c, e := client.DialTLS(addr, nil)
+			c, e := client.DialTLS(cfg.ImapServer, nil)
 			if e != nil {
 				panic(e)
 			}
@@ -79,18 +105,72 @@ func main() {
 			if e := c.Authenticate(a); e != nil {
 				panic(e)
 			}
+			if e := EnableUTF8(c); e != nil {
+				panic(e)
+			}
 			for {
 				if timed_out == true {
 					return
 				}
-				for title, raw_title := range folder_list {
+				if cfg.Discover {
+					if l, e := DiscoverFolders(c, cfg); e != nil {
+						fmt.Fprintf(os.Stderr, "%s connection error!\n", time.Now().Format("15:04:05"))
+						return
+					} else {
+						for title, folder := range l {
+							if _, ok := folder_list[title]; !ok {
+								fmt.Fprintf(os.Stderr, "syncing folder %s as %s\n", folder.Remote, title)
+							}
+						}
+						folder_list = l
+					}
+					// carry renames over to the other side (fixed folders have fixed names)
+					if e := SyncRenames(c, cfg, folder_list, mem); e != nil {
+						fmt.Fprintf(os.Stderr, "%s connection error!\n", time.Now().Format("15:04:05"))
+						return
+					}
+				}
+				// create missing folders on either side
+				active, e := EnsureFolders(c, cfg, folder_list)
+				if e != nil {
+					fmt.Fprintf(os.Stderr, "%s connection error!\n", time.Now().Format("15:04:05"))
+					return
+				}
+				// repeat local moves between folders on the server
+				if e := SyncMoves(c, directory, active, mem); e != nil {
+					fmt.Fprintf(os.Stderr, "%s connection error!\n", time.Now().Format("15:04:05"))
+					return
+				}
+				for title, folder := range active {
+					if folder.Storage == "" {
+						folder.Storage = cfg.Storage
+					}
+					if folder.LineEndings == "" {
+						folder.LineEndings = cfg.LineEndings
+					}
+					if folder.UploadSize == nil {
+						folder.UploadSize = cfg.UploadSize
+					}
+					if folder.DownloadSize == nil {
+						folder.DownloadSize = cfg.DownloadSize
+					}
+					if folder.HeadersOlderThan == 0 {
+						folder.HeadersOlderThan = cfg.HeadersOlderThan
+					}
+					folder.vars = map[string]string{"{folder}": title, "{remote}": folder.Remote, "{server}": cfg.ImapServer}
+					folder.quarantine = filepath.Join(directory, "quarantine", title)
+					folder.offline = filepath.Join(directory, "offline")
 					D := maildir.Dir(filepath.Join(directory, title))
+					// nested folders may come before (or without) their parent
+					if e := os.MkdirAll(filepath.Dir(string(D)), os.ModePerm); e != nil {
+						panic(e)
+					}
 					if e := D.Init(); e != nil {
 						panic(e)
 					}
 
 					var mbox *imap.MailboxStatus
-					if m, e := c.Select(raw_title, false); e != nil {
+					if m, e := SelectMailbox(c, folder.Remote, folder.Direction == DirectionPull); e != nil {
 						fmt.Fprintf(os.Stderr, "%s connection error!\n", time.Now().Format("15:04:05"))
 						return
 					} else {
@@ -99,6 +179,7 @@ func main() {
 					if mem.Boxes[title].Keys == nil {
 						box := MemoryMailbox{
 							Keys: make(map[uint32]string),
+							Info: make(map[uint32]*MessageInfo),
 						}
 						mem.Boxes[title] = box
 					} else if (mem.Boxes[title].UidValidity != nil) && (*mem.Boxes[title].UidValidity != mbox.UidValidity) {
@@ -108,32 +189,83 @@ func main() {
 						box.UidValidity = &mbox.UidValidity
 						mem.Boxes[title] = box
 					}
+					if mem.Boxes[title].Info == nil || mem.Boxes[title].Quarantine == nil || mem.Boxes[title].Window == nil || mem.Boxes[title].Pending == nil {
+						box := mem.Boxes[title]
+						if box.Info == nil {
+							box.Info = make(map[uint32]*MessageInfo)
+						}
+						if box.Quarantine == nil {
+							box.Quarantine = make(map[uint32]string)
+						}
+						if box.Window == nil {
+							box.Window = make(map[uint32]bool)
+						}
+						if box.Pending == nil {
+							box.Pending = make(map[string]bool)
+						}
+						mem.Boxes[title] = box
+					}
+					if box := mem.Boxes[title]; box.Remote != folder.Remote || box.Inode == 0 {
+						box.Remote = folder.Remote
+						box.Inode = dirInode(string(D))
+						mem.Boxes[title] = box
+					}
 					// check keys compare to memory
 					// uploading new items (usually for sent)
+					kw, e := LoadKeywords(D)
+					if e != nil {
+						panic(e)
+					}
 					if mb, ok := mem.Boxes[title]; ok {
-						if addr == "outlook.office365.com:993" {
-							if e := UploadHandler(c, D, mbox, &mb, true, 11000); e != nil {
-								panic(e)
-							}
-						} else {
-							if e := UploadHandler(c, D, mbox, &mb, false, 20000); e != nil {
+						if folder.Direction != DirectionPull {
+							if e := UploadHandler(c, D, mbox, &mb, folder, kw); e != nil {
 								panic(e)
 							}
 						}
-						if e := DownloadHandler(c, D, mbox, &mb); e != nil {
+						if e := DownloadHandler(c, D, mbox, &mb, folder, kw); e != nil {
 							panic(e)
 						}
+						mem.Boxes[title] = mb
 					} else {
 						panic(ok)
 					}
+					if e := kw.Save(); e != nil {
+						panic(e)
+					}
 					if e := mem.MemorySave(); e != nil {
 						panic(e)
 					}
 				}
 
+				// complete partial messages asked for on the socket
+			FETCH:
+				for {
+					select {
+					case req := <-fetch_requests:
+						req.Done <- FetchFull(c, directory, active, mem, req.Id)
+					default:
+						break FETCH
+					}
+				}
+
 				// IDLE loop
-				if _, e := c.Select("INBOX", false); e != nil {
-					panic(e)
+				// IDLE only watches one mailbox, INBOX if it is watched;
+				// any further watched folders are polled, and without any all of them are
+				var watched []*Folder
+				for _, folder := range active {
+					if folder.Watch {
+						watched = append(watched, folder)
+					}
+				}
+				sort.Slice(watched, func(i, j int) bool {
+					if a, b := strings.EqualFold(watched[i].Remote, "INBOX"), strings.EqualFold(watched[j].Remote, "INBOX"); a != b {
+						return a
+					}
+					return watched[i].Remote < watched[j].Remote
+				})
+				var poll <-chan time.Time
+				if len(watched) != 1 {
+					poll = time.After(poll_interval)
 				}
 				fmt.Fprintf(os.Stderr, "%s ... ", time.Now().Format("15:04:05"))
 				updates := make(chan client.Update)
@@ -141,9 +273,19 @@ func main() {
 				stop := make(chan struct{})
 				c.Updates = updates
 				var stopped bool
-				go func() {
-					done <- c.Idle(stop, nil)
-				}()
+				if len(watched) > 0 {
+					if _, e := SelectMailbox(c, watched[0].Remote, watched[0].Direction == DirectionPull); e != nil {
+						panic(e)
+					}
+					go func() {
+						done <- c.Idle(stop, nil)
+					}()
+				} else {
+					go func() {
+						<-stop
+						done <- nil
+					}()
+				}
 			INNER:
 				for {
 					select {
@@ -172,6 +314,11 @@ func main() {
 							close(stop)
 						}
 						kill_signal = true
+					case <-poll:
+						if !stopped {
+							stopped = true
+							close(stop)
+						}
 					case <-socket_chan:
 						if !stopped {
 							stopped = true
@@ -7,8 +7,39 @@ import (
 
 // handle memory... pretty basic idea
 type MemoryMailbox struct {
-	UidValidity *uint32           `json:"uid_validity"`
-	Keys        map[uint32]string `json:"keys"`
+	UidValidity *uint32                 `json:"uid_validity"`
+	Keys        map[uint32]string       `json:"keys"`
+	Info        map[uint32]*MessageInfo `json:"info,omitempty"`
+	// messages which could not be parsed, by UID, with their key in the quarantine maildir;
+	// they are neither fetched again nor taken for local deletions
+	Quarantine map[uint32]string `json:"quarantine,omitempty"`
+	// messages which exist on the server but are outside the date window (Folder.Days),
+	// as opposed to deleted ones
+	Window map[uint32]bool `json:"window,omitempty"`
+	// local keys of a push folder which were uploaded but got no known UID;
+	// nothing downloads them again, so they are kept and not uploaded twice
+	Pending map[string]bool `json:"pending,omitempty"`
+	// remote name and local directory inode at the last sync, to recognise renames
+	Remote string `json:"remote,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+	// UIDNEXT and number of messages as of the last download, so that looking for moves
+	// can skip the folders which did not change since
+	UidNext  uint32 `json:"uid_next,omitempty"`
+	Messages uint32 `json:"messages,omitempty"`
+}
+
+// fingerprint of a message, used to recognise it after it moved folders
+type MessageInfo struct {
+	MessageId string `json:"message_id,omitempty"`
+	Hash      string `json:"hash"`
+	// RFC822.SIZE on the server
+	Size uint32 `json:"size,omitempty"`
+	// X-GM-MSGID, for folders with labels
+	GmailId string `json:"gmail_id,omitempty"`
+	// only the headers were downloaded, see SizeHeaders
+	Partial bool `json:"partial,omitempty"`
+	// name of the whole message in the offline archive, for stubs left by SizeOffline
+	Offline string `json:"offline,omitempty"`
 }
 
 type Memory struct {
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-maildir"
+)
+
+const CodeCopyUid imap.StatusRespCode = "COPYUID"
+
+// copyUidHandler picks up the untagged COPYUID response sent by MOVE.
+type copyUidHandler struct {
+	status *imap.StatusResp
+}
+
+func (h *copyUidHandler) Handle(resp imap.Resp) error {
+	if s, ok := resp.(*imap.StatusResp); ok && s.Code == CodeCopyUid {
+		h.status = s
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// UidExpunge is a UID EXPUNGE command, as defined in RFC 4315.
+type UidExpunge struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *UidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.SeqSet},
+	}
+}
+
+// expungeUids expunges the messages seq (UIDs) of the selected mailbox.
+// Without UIDPLUS this is a plain EXPUNGE, which takes any other \Deleted message along,
+// see pushableFlags.
+func expungeUids(c *client.Client, seq *imap.SeqSet) error {
+	if uidplus, _ := c.Support("UIDPLUS"); !uidplus {
+		return c.Expunge(nil)
+	}
+	if s, e := c.Execute(&UidExpunge{seq}, nil); e != nil {
+		return e
+	} else {
+		return statusErr(s)
+	}
+}
+
+// MoveUid moves the message uid from the selected mailbox to dest and returns its UID in dest.
+// Without MOVE it falls back to COPY, STORE and EXPUNGE.
+// If the server does not report COPYUID, dest is selected and searched for message_id.
+func MoveUid(c *client.Client, uid uint32, dest string, message_id string) (uint32, error) {
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	h := new(copyUidHandler)
+	var cmd imap.Commander = &commands.Uid{Cmd: &commands.Move{SeqSet: seq, Mailbox: dest}}
+	ok, _ := c.Support("MOVE")
+	if !ok {
+		cmd = &commands.Uid{Cmd: &commands.Copy{SeqSet: seq, Mailbox: dest}}
+	}
+	status, e := c.Execute(mailboxCommand(cmd), h)
+	if e != nil {
+		return 0, e
+	} else if e := statusErr(status); e != nil {
+		return 0, e
+	}
+	if !ok {
+		if e := c.UidStore(seq, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); e != nil {
+			return 0, e
+		}
+		if e := expungeUids(c, seq); e != nil {
+			return 0, e
+		}
+	}
+	if h.status == nil && status.Code == CodeCopyUid {
+		h.status = status
+	}
+	if h.status != nil && len(h.status.Arguments) == 3 {
+		if raw, e := imap.ParseString(h.status.Arguments[2]); e == nil {
+			if set, e := imap.ParseSeqSet(raw); e == nil && len(set.Set) == 1 && set.Set[0].Start == set.Set[0].Stop {
+				return set.Set[0].Start, nil
+			}
+		}
+	}
+	if _, e := SelectMailbox(c, dest, false); e != nil {
+		return 0, e
+	}
+	return searchMessageId(c, message_id)
+}
+
+// messageInfo fingerprints the message stored under key.
+func messageInfo(D maildir.Dir, key string) (*MessageInfo, error) {
+	f, e := D.Open(key)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, e := io.Copy(hash, f); e != nil {
+		return nil, e
+	}
+	info := &MessageInfo{Hash: fmt.Sprintf("%02x", hash.Sum(nil))}
+	if s, ok := f.(io.Seeker); ok {
+		if _, e := s.Seek(0, io.SeekStart); e != nil {
+			return nil, e
+		}
+		if msg, e := mail.ReadMessage(f); e == nil {
+			info.MessageId = msg.Header.Get("Message-Id")
+		}
+	}
+	return info, nil
+}
+
+// isMissing reports whether e says that a message is not in the maildir.
+func isMissing(e error) bool {
+	var ke *maildir.KeyError
+	return os.IsNotExist(e) || errors.As(e, &ke) && ke.N == 0
+}
+
+// SyncMoves repeats moves between folders on the other side, so that moved messages
+// are neither uploaded nor downloaded again.
+func SyncMoves(c *client.Client, directory string, folder_list map[string]*Folder, mem *Memory) error {
+	if e := syncRemoteMoves(c, directory, folder_list, mem); e != nil {
+		return e
+	}
+	return syncLocalMoves(c, directory, folder_list, mem)
+}
+
+// syncRemoteMoves finds messages which were moved between folders on the server
+// and renames the local files into the target maildir.
+// A message counts as moved when its UID vanished from one folder and a new UID
+// with the same Message-ID and size showed up in another.
+// Folders whose STATUS still matches the last download are not searched, since a move
+// changes both folders.
+func syncRemoteMoves(c *client.Client, directory string, folder_list map[string]*Folder, mem *Memory) error {
+	type location struct {
+		title string
+		uid   uint32
+		info  *MessageInfo
+	}
+	gone := make(map[string][]*location)
+	added := make(map[string]*imap.SeqSet)
+	var changed []string
+	for title, folder := range folder_list {
+		box := mem.Boxes[title]
+		if box.Keys == nil || box.UidValidity == nil {
+			continue
+		}
+		if box.Info == nil {
+			box.Info = make(map[uint32]*MessageInfo)
+			mem.Boxes[title] = box
+		}
+		status, e := StatusMailbox(c, folder.Remote, []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity})
+		if e != nil {
+			return e
+		} else if status.UidValidity != *box.UidValidity {
+			continue
+		} else if box.UidNext != 0 && status.UidNext == box.UidNext && status.Messages == box.Messages {
+			continue
+		}
+		changed = append(changed, title)
+	}
+	if len(changed) < 2 {
+		return nil
+	}
+	for _, title := range changed {
+		box := mem.Boxes[title]
+		if _, e := SelectMailbox(c, folder_list[title].Remote, true); e != nil {
+			return e
+		}
+		uids, e := SearchUids(c, imap.NewSearchCriteria())
+		if e != nil {
+			return e
+		}
+		remote := make(map[uint32]bool)
+		for _, uid := range uids {
+			remote[uid] = true
+			if _, ok := box.Keys[uid]; !ok && !box.Window[uid] {
+				if added[title] == nil {
+					added[title] = new(imap.SeqSet)
+				}
+				added[title].AddNum(uid)
+			}
+		}
+		for uid := range box.Keys {
+			if info := box.Info[uid]; !remote[uid] && info != nil && info.MessageId != "" {
+				gone[info.MessageId] = append(gone[info.MessageId], &location{title, uid, info})
+			}
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Message-Id"}},
+		Peek:         true,
+	}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, section.FetchItem()}
+	for title, seq := range added {
+		if _, e := SelectMailbox(c, folder_list[title].Remote, true); e != nil {
+			return e
+		}
+		ch, done := make(chan *imap.Message, 10), make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seq, items, ch)
+		}()
+		var found []*imap.Message
+		for msg := range ch {
+			found = append(found, msg)
+		}
+		if e := <-done; e != nil {
+			return e
+		}
+		for _, msg := range found {
+			r := msg.GetBody(section)
+			if r == nil {
+				continue
+			}
+			m, e := mail.ReadMessage(r)
+			if e != nil {
+				continue
+			}
+			message_id := m.Header.Get("Message-Id")
+			for i, g := range gone[message_id] {
+				if g.title == title || (g.info.Size != 0 && g.info.Size != msg.Size) || folder_list[g.title].Direction == DirectionPush {
+					continue
+				}
+				gone[message_id] = append(gone[message_id][:i:i], gone[message_id][i+1:]...)
+				source, target := mem.Boxes[g.title], mem.Boxes[title]
+				from := maildir.Dir(filepath.Join(directory, g.title))
+				to := maildir.Dir(filepath.Join(directory, title))
+				if e := from.Move(to, source.Keys[g.uid]); isMissing(e) {
+					// gone locally as well, let the handlers sort it out
+					break
+				} else if e != nil {
+					return e
+				}
+				fmt.Fprintf(os.Stderr, "%s moving %d from local %s to %d in %s\n", time.Now().Format("15:04:05"), g.uid, g.title, msg.Uid, title)
+				g.info.Size = msg.Size
+				target.Keys[msg.Uid] = source.Keys[g.uid]
+				target.Info[msg.Uid] = g.info
+				delete(source.Keys, g.uid)
+				delete(source.Info, g.uid)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// syncLocalMoves finds messages which the MUA moved between local folders since the last sync
+// and moves them on the server as well, instead of uploading them again.
+// A message counts as moved when its key vanished from one folder and a new file
+// with the same content hash and Message-ID showed up in another.
+func syncLocalMoves(c *client.Client, directory string, folder_list map[string]*Folder, mem *Memory) error {
+	type location struct {
+		title string
+		uid   uint32
+		key   string
+		info  *MessageInfo
+	}
+	gone := make(map[string][]*location)
+	var fresh []*location
+	for title := range folder_list {
+		D := maildir.Dir(filepath.Join(directory, title))
+		keys, e := D.Keys()
+		if e != nil {
+			// not created yet
+			continue
+		}
+		box := mem.Boxes[title]
+		if box.Keys == nil {
+			continue
+		}
+		if box.Info == nil {
+			box.Info = make(map[uint32]*MessageInfo)
+			mem.Boxes[title] = box
+		}
+		on_disk := make(map[string]bool)
+		for _, k := range keys {
+			on_disk[k] = true
+		}
+		known := make(map[string]bool)
+		for uid, key := range box.Keys {
+			known[key] = true
+			if !on_disk[key] {
+				if info := box.Info[uid]; info != nil {
+					gone[info.Hash] = append(gone[info.Hash], &location{title, uid, key, info})
+				}
+			} else if box.Info[uid] == nil {
+				// fingerprint messages from before we kept track
+				if info, e := messageInfo(D, key); e == nil {
+					box.Info[uid] = info
+				}
+			}
+		}
+		for _, k := range keys {
+			if !known[k] {
+				if info, e := messageInfo(D, k); e == nil {
+					fresh = append(fresh, &location{title, 0, k, info})
+				}
+			}
+		}
+	}
+	for _, f := range fresh {
+		candidates := gone[f.info.Hash]
+		for i, g := range candidates {
+			if g.title == f.title || g.info.MessageId != f.info.MessageId {
+				continue
+			} else if folder_list[g.title].Direction == DirectionPull || folder_list[f.title].Direction == DirectionPull {
+				// never modify the server for these
+				continue
+			}
+			gone[f.info.Hash] = append(candidates[:i:i], candidates[i+1:]...)
+			if _, e := SelectMailbox(c, folder_list[g.title].Remote, false); e != nil {
+				return e
+			}
+			fmt.Fprintf(os.Stderr, "%s moving %d from remote %s to %s\n", time.Now().Format("15:04:05"), g.uid, folder_list[g.title].Remote, folder_list[f.title].Remote)
+			nuid, e := MoveUid(c, g.uid, folder_list[f.title].Remote, f.info.MessageId)
+			if _, refused := e.(*RefusedError); refused {
+				// e.g. over quota; the message is uploaded and deleted like any other
+				fmt.Fprintf(os.Stderr, "cannot move %d, skipping: %s\n", g.uid, e)
+				break
+			} else if e != nil {
+				return e
+			}
+			delete(mem.Boxes[g.title].Keys, g.uid)
+			delete(mem.Boxes[g.title].Info, g.uid)
+			if target := mem.Boxes[f.title]; nuid != 0 && target.Keys != nil {
+				target.Keys[nuid] = f.key
+				target.Info[nuid] = f.info
+			} else if folder_list[f.title].Direction == DirectionPush {
+				// nothing downloads it again, keep it like UploadHandler does
+				if target.Keys == nil {
+					target.Keys = make(map[uint32]string)
+					target.Info = make(map[uint32]*MessageInfo)
+				}
+				if target.Pending == nil {
+					target.Pending = make(map[string]bool)
+				}
+				target.Pending[f.key] = true
+				mem.Boxes[f.title] = target
+			} else {
+				// cannot tell which uid it got, the download brings it back
+				D := maildir.Dir(filepath.Join(directory, f.title))
+				if e := D.Remove(f.key); e != nil {
+					return e
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-maildir"
+)
+
+var fetch_flag = flag.String("f", "", "fetch the whole message for a partial maildir key or Message-ID")
+
+// FetchRequest asks the sync loop to complete a partial message, see FetchFull.
+type FetchRequest struct {
+	Id   string
+	Done chan error
+}
+
+// requestFetch hands id to the instance listening on the control socket in directory.
+func requestFetch(directory string, id string) error {
+	sock_addr := filepath.Join(directory, ".socket")
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", sock_addr)
+		},
+	}}
+	resp, e := hc.Get("http://socket/fetch?id=" + url.QueryEscape(id))
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimSpace(string(msg)))
+	}
+	fmt.Print(string(msg))
+	return nil
+}
+
+// FetchFull downloads the whole message for a partial one, given its maildir key or Message-ID,
+// and replaces the stub in place, keeping key and flags.
+// Messages in the offline archive are taken from there instead of the server.
+func FetchFull(c *client.Client, directory string, folder_list map[string]*Folder, mem *Memory, id string) error {
+	for title, folder := range folder_list {
+		box := mem.Boxes[title]
+		for uid, info := range box.Info {
+			key := box.Keys[uid]
+			if !info.Partial || (key != id && strings.Trim(info.MessageId, "<>") != strings.Trim(id, "<>")) {
+				continue
+			}
+			D := maildir.Dir(filepath.Join(directory, title))
+			var raw []byte
+			if info.Offline != "" {
+				if b, e := os.ReadFile(filepath.Join(folder.offline, info.Offline)); e == nil {
+					raw = b
+				}
+			}
+			if raw == nil {
+				b, e := fetchUid(c, folder.Remote, uid)
+				if e != nil {
+					return e
+				}
+				raw = b
+			}
+			if e := replaceMessage(D, key, raw, folder); e != nil {
+				return e
+			}
+			if nu, e := messageInfo(D, key); e == nil {
+				nu.Size, nu.GmailId = info.Size, info.GmailId
+				box.Info[uid] = nu
+			}
+			fmt.Fprintf(os.Stderr, "fetched %d in %s as %s\n", uid, folder.Remote, key)
+			return mem.MemorySave()
+		}
+	}
+	return fmt.Errorf("no partial message %s", id)
+}
+
+// fetchUid returns the whole message uid in mbox.
+func fetchUid(c *client.Client, mbox string, uid uint32) ([]byte, error) {
+	if _, e := SelectMailbox(c, mbox, true); e != nil {
+		return nil, e
+	}
+	seq := new(imap.SeqSet)
+	seq.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+	ch, done := make(chan *imap.Message, 1), make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, ch)
+	}()
+	var raw []byte
+	for msg := range ch {
+		if r := msg.GetBody(section); r != nil {
+			raw, _ = io.ReadAll(r)
+		}
+	}
+	if e := <-done; e != nil {
+		return nil, e
+	} else if raw == nil {
+		return nil, fmt.Errorf("message %d is gone from %s", uid, mbox)
+	}
+	return raw, nil
+}
+
+// replaceMessage writes raw the way DownloadHandler would into D's tmp and renames it
+// over the file of key, so readers see either the stub or the whole message.
+func replaceMessage(D maildir.Dir, key string, raw []byte, folder *Folder) error {
+	s, e := D.Filename(key)
+	if e != nil {
+		return e
+	}
+	f, e := os.CreateTemp(filepath.Join(string(D), "tmp"), key)
+	if e != nil {
+		return e
+	}
+	if policy := folder.headerPolicy(false); policy == nil {
+		_, e = CopyMessage(f, bytes.NewReader(raw), folder.LineEndings)
+	} else if msg, err := parseMessage(raw, time.Time{}); err != nil {
+		// like quarantine, keep what the server sent
+		_, e = f.Write(raw)
+	} else {
+		_, e = WriteMessage(policy.Apply(msg.Header, folder.vars), bufio.NewReader(msg.Body), f)
+	}
+	if e != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return e
+	} else if e := f.Close(); e != nil {
+		os.Remove(f.Name())
+		return e
+	}
+	return os.Rename(f.Name(), s)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+)
+
+// how many known messages are compared before a mailbox counts as renamed
+const rename_samples = 5
+
+// dirInode returns the inode of the directory at path, zero if unknown.
+func dirInode(path string) uint64 {
+	if info, e := os.Stat(path); e == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return uint64(st.Ino)
+		}
+	}
+	return 0
+}
+
+// sameMailbox reports whether the remote mailbox name holds the messages remembered in box:
+// the UIDVALIDITY has to match, as well as the Message-IDs of a few known UIDs.
+func sameMailbox(c *client.Client, name string, box MemoryMailbox) (bool, error) {
+	mbox, e := SelectMailbox(c, name, true)
+	if e != nil {
+		return false, e
+	} else if box.UidValidity == nil || mbox.UidValidity != *box.UidValidity {
+		return false, nil
+	}
+	seq := new(imap.SeqSet)
+	var n int
+	for uid := range box.Keys {
+		if info := box.Info[uid]; info != nil && info.MessageId != "" && n < rename_samples {
+			seq.AddNum(uid)
+			n++
+		}
+	}
+	if n == 0 {
+		return false, nil
+	}
+	section := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: []string{"Message-Id"}},
+		Peek:         true,
+	}
+	ch, done := make(chan *imap.Message, 10), make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, ch)
+	}()
+	var matches int
+	for msg := range ch {
+		if r := msg.GetBody(section); r != nil {
+			if m, e := mail.ReadMessage(r); e == nil && box.Info[msg.Uid] != nil && m.Header.Get("Message-Id") == box.Info[msg.Uid].MessageId {
+				matches++
+			}
+		}
+	}
+	if e := <-done; e != nil {
+		return false, e
+	}
+	return matches == n, nil
+}
+
+// SyncRenames recognises folders which were renamed on either side since the last sync
+// and repeats the rename on the other side, instead of deleting and downloading everything.
+// Remote renames are recognised by UIDVALIDITY and message fingerprints, local renames by the
+// inode of the maildir. Only used with cfg.Discover, where the folder names follow the server:
+// the names of configured and default folders are fixed, so there is nothing to rename them to.
+func SyncRenames(c *client.Client, cfg *Config, folder_list map[string]*Folder, mem *Memory) error {
+	infos, e := ListMailboxes(c)
+	if e != nil {
+		return e
+	}
+	exists := make(map[string]bool)
+	var delim string
+	for _, info := range infos {
+		exists[info.Name] = true
+		if delim == "" {
+			delim = info.Delimiter
+		}
+	}
+	// remote names and local titles nobody remembers yet
+	fresh_remote := make(map[string]string)
+	for title, folder := range folder_list {
+		if _, ok := mem.Boxes[title]; !ok {
+			fresh_remote[folder.Remote] = title
+		}
+	}
+	local_titles, e := localMaildirs(cfg.Directory)
+	if e != nil {
+		return e
+	}
+	fresh_local := make(map[uint64]string)
+	for _, title := range local_titles {
+		if _, ok := mem.Boxes[title]; !ok {
+			fresh_local[dirInode(filepath.Join(cfg.Directory, title))] = title
+		}
+	}
+
+	for title, box := range mem.Boxes {
+		if box.Remote == "" || box.Keys == nil {
+			continue
+		}
+		old_dir := filepath.Join(cfg.Directory, title)
+		if _, e := os.Stat(old_dir); e == nil && exists[box.Remote] {
+			continue
+		} else if e == nil {
+			// renamed on the server
+			for name, new_title := range fresh_remote {
+				if same, e := sameMailbox(c, name, box); e != nil {
+					return e
+				} else if !same {
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "%s renaming local %s to %s\n", time.Now().Format("15:04:05"), title, new_title)
+				new_dir := filepath.Join(cfg.Directory, new_title)
+				if e := os.MkdirAll(filepath.Dir(new_dir), os.ModePerm); e != nil {
+					return e
+				}
+				if e := os.Rename(old_dir, new_dir); e != nil {
+					return e
+				}
+				box.Remote = name
+				mem.Boxes[new_title] = box
+				delete(mem.Boxes, title)
+				delete(fresh_remote, name)
+				break
+			}
+		} else if new_title, ok := fresh_local[box.Inode]; ok && box.Inode != 0 && exists[box.Remote] {
+			// renamed locally
+			folder := folder_list[title]
+			if folder == nil {
+				folder = &Folder{Direction: DirectionBoth}
+			}
+			name := RemoteName(new_title, delim, cfg.Layout)
+			if folder.Direction == DirectionPull {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s renaming remote %s to %s\n", time.Now().Format("15:04:05"), box.Remote, name)
+			if status, e := c.Execute(mailboxCommand(&commands.Rename{Existing: box.Remote, New: name}), nil); e != nil {
+				return e
+			} else if e := statusErr(status); e != nil {
+				// e.g. the name is taken by an excluded mailbox; the maildir counts as a new one
+				fmt.Fprintf(os.Stderr, "cannot rename %s to %s, skipping: %s\n", box.Remote, name, e)
+				continue
+			}
+			folder.Remote = name
+			box.Remote = name
+			delete(folder_list, title)
+			folder_list[new_title] = folder
+			mem.Boxes[new_title] = box
+			delete(mem.Boxes, title)
+			delete(fresh_local, box.Inode)
+		}
+	}
+	return nil
+}
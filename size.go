@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// move the message to the offline archive; downloads leave a stub, see MessageInfo.Offline
+	SizeOffline = "offline"
+	// leave the message where it is
+	SizeSkip = "skip"
+	// upload or download it anyway
+	SizeSync = "sync"
+	// download only the headers (downloads only), see MessageInfo.Partial
+	SizeHeaders = "headers"
+)
+
+// SizePolicy decides what happens to messages larger than Limit bytes.
+type SizePolicy struct {
+	Limit  int64  `json:"limit"`
+	Action string `json:"action"`
+}
+
+// check validates the policy and fills in the default action,
+// SizeOffline for uploads and SizeSkip for downloads.
+func (p *SizePolicy) check(download bool) error {
+	switch p.Action {
+	case "":
+		if p.Action = SizeOffline; download {
+			p.Action = SizeSkip
+		}
+	case SizeSkip, SizeSync, SizeOffline:
+	case SizeHeaders:
+		if !download {
+			return fmt.Errorf("size action %q is for downloads only", p.Action)
+		}
+	default:
+		return fmt.Errorf("unknown size action %q", p.Action)
+	}
+	return nil
+}
+
+// Decide returns the action for a message of size bytes.
+// A nil policy or a zero Limit lets everything through.
+func (p *SizePolicy) Decide(size int64) string {
+	if p == nil || p.Limit <= 0 || size <= p.Limit {
+		return SizeSync
+	}
+	return p.Action
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestSizePolicyDecide(t *testing.T) {
+	tests := []struct {
+		policy *SizePolicy
+		size   int64
+		action string
+	}{
+		{nil, 1 << 30, SizeSync},
+		{&SizePolicy{Limit: 0, Action: SizeSkip}, 1 << 30, SizeSync},
+		{&SizePolicy{Limit: 100, Action: SizeSkip}, 100, SizeSync},
+		{&SizePolicy{Limit: 100, Action: SizeSkip}, 101, SizeSkip},
+		{&SizePolicy{Limit: 100, Action: SizeHeaders}, 101, SizeHeaders},
+		{&SizePolicy{Limit: 100, Action: SizeOffline}, 101, SizeOffline},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Decide(tt.size); got != tt.action {
+			t.Errorf("%+v.Decide(%d) = %q, want %q", tt.policy, tt.size, got, tt.action)
+		}
+	}
+}
+
+func TestSizePolicyCheck(t *testing.T) {
+	tests := []struct {
+		action   string
+		download bool
+		want     string
+		ok       bool
+	}{
+		{"", false, SizeOffline, true},
+		{"", true, SizeSkip, true},
+		{SizeHeaders, true, SizeHeaders, true},
+		{SizeHeaders, false, "", false},
+		{"bogus", true, "", false},
+	}
+	for _, tt := range tests {
+		p := &SizePolicy{Limit: 1, Action: tt.action}
+		if e := p.check(tt.download); (e == nil) != tt.ok {
+			t.Errorf("check(%q, %v) = %v", tt.action, tt.download, e)
+		} else if tt.ok && p.Action != tt.want {
+			t.Errorf("check(%q, %v) set %q, want %q", tt.action, tt.download, p.Action, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// DecodeMailboxName turns a modified UTF-7 mailbox name (RFC 3501 section 5.1.3) into UTF-8.
+// Names which are not valid modified UTF-7, like the raw UTF-8 sent after ENABLE UTF8=ACCEPT, are returned as is.
+func DecodeMailboxName(name string) string {
+	if s, e := utf7.Encoding.NewDecoder().String(name); e == nil {
+		return s
+	}
+	return name
+}
+
+// EncodeMailboxName turns a UTF-8 mailbox name into modified UTF-7.
+// go-imap already does this for its own commands.
+func EncodeMailboxName(name string) string {
+	s, _ := utf7.Encoding.NewEncoder().String(name)
+	return s
+}
+
+// utf8_accept is set when UTF8=ACCEPT is enabled on the current connection
+// (there is only ever one); mailbox names are then sent in UTF-8, see utf8Names.
+var utf8_accept bool
+
+// EnableUTF8 enables UTF8=ACCEPT (RFC 6855) if the server supports it.
+// Must be called before a mailbox is selected.
+func EnableUTF8(c *client.Client) error {
+	utf8_accept = false
+	if ok, _ := c.Support("UTF8=ACCEPT"); !ok {
+		return nil
+	}
+	caps, e := c.Enable([]string{"UTF8=ACCEPT"})
+	for _, cap := range caps {
+		if strings.EqualFold(cap, "UTF8=ACCEPT") {
+			utf8_accept = true
+		}
+	}
+	return e
+}
+
+// utf8Names sends a go-imap command with its mailbox names in UTF-8 instead of modified UTF-7,
+// as they have to be after ENABLE UTF8=ACCEPT. It must only wrap commands whose only
+// string arguments are mailbox names (SELECT, STATUS, CREATE, RENAME, SUBSCRIBE, APPEND, COPY, MOVE).
+type utf8Names struct {
+	imap.Commander
+}
+
+func (cmd utf8Names) Command() *imap.Command {
+	c := cmd.Commander.Command()
+	for i, arg := range c.Arguments {
+		if s, ok := arg.(string); ok {
+			c.Arguments[i] = DecodeMailboxName(s)
+		}
+	}
+	return c
+}
+
+// mailboxCommand returns cmd ready to be sent on the current connection, see utf8Names.
+func mailboxCommand(cmd imap.Commander) imap.Commander {
+	if utf8_accept {
+		return utf8Names{cmd}
+	}
+	return cmd
+}
+
+// SelectMailbox is c.Select, with the name in UTF-8 after ENABLE UTF8=ACCEPT.
+func SelectMailbox(c *client.Client, name string, read_only bool) (*imap.MailboxStatus, error) {
+	if !utf8_accept {
+		return c.Select(name, read_only)
+	}
+	mbox := &imap.MailboxStatus{Name: name, Items: make(map[imap.StatusItem]interface{})}
+	// as c.Select, so that unilateral updates go to mbox
+	c.SetState(imap.SelectedState, mbox)
+	status, e := c.Execute(utf8Names{&commands.Select{Mailbox: name, ReadOnly: read_only}}, &responses.Select{Mailbox: mbox})
+	if e == nil {
+		e = status.Err()
+	}
+	if e != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, e
+	}
+	mbox.ReadOnly = status.Code == imap.CodeReadOnly
+	return mbox, nil
+}
+
+// StatusMailbox is c.Status, with the name in UTF-8 after ENABLE UTF8=ACCEPT.
+func StatusMailbox(c *client.Client, name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	h := &statusHandler{responses.Status{Mailbox: new(imap.MailboxStatus)}}
+	status, e := c.Execute(mailboxCommand(&commands.Status{Mailbox: name, Items: items}), h)
+	if e != nil {
+		return nil, e
+	}
+	return h.Mailbox, status.Err()
+}
+
+// SearchUids is c.UidSearch; after ENABLE UTF8=ACCEPT the criteria are UTF-8 anyway
+// and RFC 6855 does not allow a CHARSET, which go-imap always sends.
+func SearchUids(c *client.Client, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if !utf8_accept {
+		return c.UidSearch(criteria)
+	}
+	h := new(responses.Search)
+	status, e := c.Execute(&commands.Uid{Cmd: &commands.Search{Criteria: criteria}}, h)
+	if e != nil {
+		return nil, e
+	}
+	return h.Ids, status.Err()
+}
+
+// statusHandler is responses.Status, but accepts raw UTF-8 mailbox names like listHandler.
+type statusHandler struct {
+	responses.Status
+}
+
+func (h *statusHandler) Handle(resp imap.Resp) error {
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && name == "STATUS" && len(fields) > 0 {
+		if raw, e := imap.ParseString(fields[0]); e == nil {
+			fields[0] = EncodeMailboxName(DecodeMailboxName(raw))
+		}
+	}
+	return h.Status.Handle(resp)
+}
+
+// listHandler is responses.List, but accepts the UTF-8 mailbox names sent after ENABLE UTF8=ACCEPT,
+// which go-imap would reject as invalid modified UTF-7.
+type listHandler struct {
+	responses.List
+}
+
+func (h *listHandler) Handle(resp imap.Resp) error {
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && name == "LIST" && len(fields) == 3 {
+		if raw, e := imap.ParseString(fields[2]); e == nil {
+			fields[2] = EncodeMailboxName(DecodeMailboxName(raw))
+		}
+	}
+	return h.List.Handle(resp)
+}
+
+// ListMailboxes lists all remote mailboxes, with their names in UTF-8.
+func ListMailboxes(c *client.Client) ([]*imap.MailboxInfo, error) {
+	ch, done := make(chan *imap.MailboxInfo, 10), make(chan error, 1)
+	go func() {
+		h := &listHandler{responses.List{Mailboxes: ch}}
+		status, e := c.Execute(&commands.List{Reference: "", Mailbox: "*"}, h)
+		close(ch)
+		if e == nil {
+			e = status.Err()
+		}
+		done <- e
+	}()
+	var infos []*imap.MailboxInfo
+	for info := range ch {
+		infos = append(infos, info)
+	}
+	return infos, <-done
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-maildir"
+)
+
+// applyWindow narrows the selected mailbox to the messages of the last folder.Days days
+// (by INTERNALDATE) and returns their UIDs, or nil without a window.
+// Local messages which fell out of the window are removed locally only and recorded in
+// mem.Window, so that neither side takes them for deleted; they come back when the window grows.
+func applyWindow(c *client.Client, D maildir.Dir, mbox *imap.MailboxStatus, mem *MemoryMailbox, folder *Folder) (*imap.SeqSet, error) {
+	if folder.Days <= 0 {
+		return nil, nil
+	}
+	all, e := SearchUids(c, imap.NewSearchCriteria())
+	if e != nil {
+		return nil, e
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Since = time.Now().AddDate(0, 0, -folder.Days)
+	recent, e := SearchUids(c, criteria)
+	if e != nil {
+		return nil, e
+	}
+	exists, in_window := make(map[uint32]bool), make(map[uint32]bool)
+	for _, uid := range all {
+		exists[uid] = true
+	}
+	seq := new(imap.SeqSet)
+	for _, uid := range recent {
+		in_window[uid] = true
+		seq.AddNum(uid)
+	}
+	for uid := range mem.Window {
+		if !exists[uid] || in_window[uid] {
+			// deleted on the server, or to be downloaded again
+			delete(mem.Window, uid)
+		}
+	}
+	if folder.Direction == DirectionPush {
+		// never delete anything locally
+		return seq, nil
+	}
+	out := new(imap.SeqSet)
+	for uid, key := range mem.Keys {
+		if exists[uid] && !in_window[uid] {
+			if e := D.Remove(key); e != nil && !os.IsNotExist(e) {
+				return nil, e
+			}
+			out.AddNum(uid)
+			delete(mem.Keys, uid)
+			delete(mem.Info, uid)
+			mem.Window[uid] = true
+		}
+	}
+	if !out.Empty() {
+		fmt.Fprintf(os.Stderr, "%s out of the %d day window, removing from local %s\n", out.String(), folder.Days, mbox.Name)
+	}
+	return seq, nil
+}
@@ -2,11 +2,205 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"net/mail"
+	"mime"
+	"strings"
 )
 
+const (
+	// store messages byte for byte as the server sent them
+	StorageVerbatim = "verbatim"
+	// store only the headers in header_list, unless the folder has its own HeaderPolicy
+	StorageFiltered = "filtered"
+)
+
+const (
+	// leave line endings alone
+	LineEndingsKeep = ""
+	LineEndingsLF   = "lf"
+	LineEndingsCRLF = "crlf"
+)
+
+// CopyMessage copies the raw message in r to w, converting the line endings according to mode.
+// Nothing but the line endings is touched, so 8bit content survives. In binary content
+// (Content-Transfer-Encoding: binary) a CR or LF is data, so such bodies are copied as they are.
+func CopyMessage(w io.Writer, r io.Reader, mode string) (n int64, e error) {
+	n, _, e = copyMessage(w, r, mode)
+	return n, e
+}
+
+// copyMessage is CopyMessage, also reporting whether there was binary content.
+func copyMessage(w io.Writer, r io.Reader, mode string) (n int64, binary bool, e error) {
+	if mode == LineEndingsKeep {
+		n, e = io.Copy(w, r)
+		return n, false, e
+	}
+	write := func(p []byte) error {
+		k, e := w.Write(p)
+		n += int64(k)
+		return e
+	}
+	eol := []byte{'\n'}
+	if mode == LineEndingsCRLF {
+		eol = []byte{'\r', '\n'}
+	}
+	br := bufio.NewReader(r)
+	s := &mimeScanner{header: true}
+	// a long line was cut right after a '\r', which may belong to the line ending
+	var cr bool
+	// the last read ended a line
+	start := true
+	// in a binary body, whose line endings are held back until it is clear
+	// that no boundary follows (the line ending before a boundary belongs to it)
+	var raw bool
+	var held []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		whole := start && err == nil
+		start = err == nil
+		if raw {
+			if whole && s.boundary(trimEOL(line)) {
+				raw, held = false, held[:0]
+				if e := write(eol); e != nil {
+					return n, binary, e
+				} else if e := write(trimEOL(line)); e != nil {
+					return n, binary, e
+				} else if e := write(eol); e != nil {
+					return n, binary, e
+				}
+				continue
+			}
+			if e := write(held); e != nil {
+				return n, binary, e
+			}
+			held = held[:0]
+			if err == nil {
+				k := len(trimEOL(line))
+				line, held = line[:k], append(held, line[k:]...)
+			}
+			if e := write(line); e != nil {
+				return n, binary, e
+			} else if err == io.EOF {
+				return n, binary, nil
+			} else if err != nil && err != bufio.ErrBufferFull {
+				return n, binary, err
+			}
+			continue
+		}
+		if err == nil {
+			if cr && len(line) == 1 {
+				cr = false
+			}
+			line = trimEOL(line)
+		}
+		if cr {
+			if e := write([]byte{'\r'}); e != nil {
+				return n, binary, e
+			}
+		}
+		if cr = err == bufio.ErrBufferFull && bytes.HasSuffix(line, []byte{'\r'}); cr {
+			line = line[:len(line)-1]
+		}
+		if e := write(line); e != nil {
+			return n, binary, e
+		}
+		if err == bufio.ErrBufferFull {
+			// long line, the rest follows
+			continue
+		} else if err == io.EOF {
+			if cr {
+				e = write([]byte{'\r'})
+			}
+			return n, binary, e
+		} else if err != nil {
+			return n, binary, err
+		}
+		if e := write(eol); e != nil {
+			return n, binary, e
+		}
+		if whole && s.line(line) {
+			raw, binary = true, true
+		}
+	}
+}
+
+// trimEOL cuts the line ending off line.
+func trimEOL(line []byte) []byte {
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte{'\n'}), []byte{'\r'})
+}
+
+// mimeScanner follows the structure of a message line by line, to find the bodies
+// with binary content. Header fields only count in header blocks, that is at the top,
+// after a multipart boundary or at the start of an attached message.
+type mimeScanner struct {
+	// in a header block
+	header bool
+	// the field being read, for folded lines
+	field string
+	// Content-Type and Content-Transfer-Encoding of the header block
+	media, encoding string
+	// of the enclosing multiparts, innermost last
+	boundaries []string
+}
+
+// line takes the next line, without its line ending, and reports whether
+// a binary body follows it.
+func (s *mimeScanner) line(l []byte) bool {
+	if !s.header {
+		s.boundary(l)
+		return false
+	} else if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') {
+		switch s.field {
+		case "content-type":
+			s.media += string(l)
+		case "content-transfer-encoding":
+			s.encoding += string(l)
+		}
+		return false
+	} else if len(l) > 0 {
+		name, value, _ := bytes.Cut(l, []byte{':'})
+		switch s.field = strings.ToLower(strings.TrimSpace(string(name))); s.field {
+		case "content-type":
+			s.media = string(value)
+		case "content-transfer-encoding":
+			s.encoding = string(value)
+		}
+		return false
+	}
+	// the end of the header block
+	binary := strings.EqualFold(strings.TrimSpace(s.encoding), "binary")
+	t, params, _ := mime.ParseMediaType(s.media)
+	s.header = t == "message/rfc822" || t == "message/global"
+	if strings.HasPrefix(t, "multipart/") && params["boundary"] != "" {
+		s.boundaries = append(s.boundaries, params["boundary"])
+	}
+	s.field, s.media, s.encoding = "", "", ""
+	return binary && !s.header
+}
+
+// boundary reports whether l is a boundary of one of the enclosing multiparts,
+// which starts the header block of the next part or closes the multipart.
+func (s *mimeScanner) boundary(l []byte) bool {
+	if !bytes.HasPrefix(l, []byte("--")) {
+		return false
+	}
+	l = bytes.TrimRight(l[2:], " \t")
+	for i := len(s.boundaries) - 1; i >= 0; i-- {
+		if b := s.boundaries[i]; string(l) == b {
+			s.boundaries = s.boundaries[:i+1]
+			s.header = true
+			return true
+		} else if string(l) == b+"--" {
+			s.boundaries = s.boundaries[:i]
+			return true
+		}
+	}
+	return false
+}
+
 var header_list = []string{
 	"From",
 	"To",
@@ -22,14 +216,46 @@ var header_list = []string{
 	"Content-Transfer-Encoding",
 }
 
-func WriteMessage(headers mail.Header, rb *bufio.Reader, w io.Writer) (n int, e error) {
-	for _, h := range header_list {
-		if v := headers.Get(h); v != "" {
-			if k, e := fmt.Fprintf(w, "%s: %s\n", h, v); e != nil {
-				return n + k, e
-			} else {
-				n += k
-			}
+// header lines are folded to this length where possible (RFC 5322 2.1.1)
+const header_line_length = 78
+
+// foldHeader formats a header field, folding the value at single spaces so that
+// lines stay within header_line_length. Encoded words (RFC 2047) contain no spaces
+// and are never split, and unfolding gives back the same value.
+// Values without suitable spaces are left long.
+func foldHeader(name, value string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+	line := len(name) + 1
+	for i := 0; i < len(value); {
+		// the next word, with the space before it
+		j := i + 1
+		for j < len(value) && !(value[j] == ' ' && value[j-1] != ' ' && value[j-1] != '\t' && j+1 < len(value) && value[j+1] != ' ' && value[j+1] != '\t') {
+			j++
+		}
+		if i == 0 {
+			b.WriteString(" ")
+			line++
+		} else if line+j-i > header_line_length {
+			b.WriteString("\n")
+			line = 0
+		}
+		b.WriteString(value[i:j])
+		line += j - i
+		i = j
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// WriteMessage writes the header fields (see HeaderPolicy.Apply) followed by the body in rb.
+func WriteMessage(fields []HeaderField, rb *bufio.Reader, w io.Writer) (n int, e error) {
+	for _, h := range fields {
+		if k, e := io.WriteString(w, foldHeader(h.Name, h.Value)); e != nil {
+			return n + k, e
+		} else {
+			n += k
 		}
 	}
 	w.Write([]byte{'\n'})
@@ -62,3 +288,89 @@ func WriteMessage(headers mail.Header, rb *bufio.Reader, w io.Writer) (n int, e
 	}
 	return n, nil
 }
+
+// StreamLiteral is an APPEND literal read from disk as the command is sent, so that
+// large messages do not have to be held in memory. Lines end in CRLF as RFC 3501
+// requires, whatever the line endings on disk; the length is taken in a counting pass.
+// Binary content is left alone (see CopyMessage), such messages have to be sent as literal8.
+type StreamLiteral struct {
+	open   func() (io.ReadCloser, error)
+	size   int
+	binary bool
+	r      *io.PipeReader
+}
+
+// NewStreamLiteral returns a literal for the message returned by open, which is called
+// once for the length and once more when the literal is sent.
+func NewStreamLiteral(open func() (io.ReadCloser, error)) (*StreamLiteral, error) {
+	l := &StreamLiteral{open: open}
+	if n, binary, e := l.copy(io.Discard); e != nil {
+		return nil, e
+	} else {
+		l.size, l.binary = int(n), binary
+	}
+	return l, nil
+}
+
+func (l *StreamLiteral) copy(w io.Writer) (int64, bool, error) {
+	r, e := l.open()
+	if e != nil {
+		return 0, false, e
+	}
+	defer r.Close()
+	return copyMessage(w, r, LineEndingsCRLF)
+}
+
+// Binary reports whether the message has binary content.
+func (l *StreamLiteral) Binary() bool {
+	return l.binary
+}
+
+func (l *StreamLiteral) Len() int {
+	return l.size
+}
+
+func (l *StreamLiteral) Read(p []byte) (int, error) {
+	if l.r == nil {
+		r, w := io.Pipe()
+		l.r = r
+		go func() {
+			// anything past size would be read as commands by the server
+			if n, _, e := l.copy(&limitWriter{w, int64(l.size)}); e != nil {
+				w.CloseWithError(e)
+			} else if n != int64(l.size) {
+				w.CloseWithError(errMessageChanged)
+			} else {
+				w.Close()
+			}
+		}()
+	}
+	return l.r.Read(p)
+}
+
+var errMessageChanged = errors.New("message changed while uploading")
+
+// limitWriter fails instead of writing more than n bytes to w.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.n {
+		return 0, errMessageChanged
+	}
+	k, e := lw.w.Write(p)
+	lw.n -= int64(k)
+	return k, e
+}
+
+// Close stops reading the message, in case the literal was not sent in full.
+// The next Read starts over, so the literal can be sent again.
+func (l *StreamLiteral) Close() error {
+	if r := l.r; r != nil {
+		l.r = nil
+		return r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestCopyMessage(t *testing.T) {
+	long := strings.Repeat("a", 4095)
+	tests := []struct {
+		in, mode, out string
+	}{
+		{"a\r\nb\r\n", LineEndingsKeep, "a\r\nb\r\n"},
+		{"a\r\nb\nc", LineEndingsLF, "a\nb\nc"},
+		{"a\r\nb\nc", LineEndingsCRLF, "a\r\nb\r\nc"},
+		{"a\rb\r\n", LineEndingsLF, "a\rb\n"},
+		{"a\r", LineEndingsLF, "a\r"},
+		// the buffer fills up right after the CR
+		{long + "\r\nb\r\n", LineEndingsLF, long + "\nb\n"},
+		{long + "\rb\r\n", LineEndingsLF, long + "\rb\n"},
+		{long + "\r", LineEndingsLF, long + "\r"},
+		{long + "a\n", LineEndingsCRLF, long + "a\r\n"},
+		// binary content is left alone
+		{"Subject: x\nContent-Transfer-Encoding: Binary\n\n\x00\r\n\n", LineEndingsCRLF, "Subject: x\r\nContent-Transfer-Encoding: Binary\r\n\r\n\x00\r\n\n"},
+		{"Content-Transfer-Encoding: binary\nSubject: hi\n\nbody\n", LineEndingsCRLF, "Content-Transfer-Encoding: binary\r\nSubject: hi\r\n\r\nbody\n"},
+		{"Content-Transfer-Encoding:\n binary\n\na\n", LineEndingsCRLF, "Content-Transfer-Encoding:\r\n binary\r\n\r\na\n"},
+		// only in header blocks
+		{"Subject: x\n\nContent-Transfer-Encoding: binary\n\na\n", LineEndingsCRLF, "Subject: x\r\n\r\nContent-Transfer-Encoding: binary\r\n\r\na\r\n"},
+		// up to the next boundary, whose line ending is converted
+		{"Content-Type: multipart/mixed;\n boundary=\"b\"\n\n--b\nContent-Transfer-Encoding: binary\n\n\x00\n\r\n--b\n\nc\n--b--\n", LineEndingsCRLF,
+			"Content-Type: multipart/mixed;\r\n boundary=\"b\"\r\n\r\n--b\r\nContent-Transfer-Encoding: binary\r\n\r\n\x00\n\r\n--b\r\n\r\nc\r\n--b--\r\n"},
+		{"Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Transfer-Encoding: binary\n\n\x00\n--b--\nend\n", LineEndingsLF,
+			"Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Transfer-Encoding: binary\n\n\x00\n--b--\nend\n"},
+		{"Content-Transfer-Encoding: base64\n\nYQ==\n", LineEndingsCRLF, "Content-Transfer-Encoding: base64\r\n\r\nYQ==\r\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		n, e := CopyMessage(&b, strings.NewReader(tt.in), tt.mode)
+		if e != nil {
+			t.Errorf("CopyMessage(%q, %q): %v", tt.in, tt.mode, e)
+		} else if b.String() != tt.out {
+			t.Errorf("CopyMessage(%q, %q) = %q, want %q", tt.in, tt.mode, b.String(), tt.out)
+		} else if n != int64(b.Len()) {
+			t.Errorf("CopyMessage(%q, %q) returned %d, wrote %d", tt.in, tt.mode, n, b.Len())
+		}
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	long := strings.Repeat("word ", 30) + "end"
+	tests := []string{
+		"short",
+		long,
+		"=?utf-8?q?" + strings.Repeat("x", 80) + "?= =?utf-8?q?" + strings.Repeat("y", 80) + "?=",
+		strings.Repeat("x", 100),
+		"two  spaces" + strings.Repeat(" z", 40),
+	}
+	for _, value := range tests {
+		folded := foldHeader("Subject", value)
+		for _, line := range strings.Split(strings.TrimSuffix(folded, "\n"), "\n") {
+			// only single words may stay long
+			if word := strings.TrimSpace(strings.TrimPrefix(line, "Subject:")); len(line) > header_line_length && strings.Contains(word, " ") {
+				t.Errorf("foldHeader(%q) left a long line %q", value, line)
+			}
+		}
+		msg, e := mail.ReadMessage(strings.NewReader(folded + "\n"))
+		if e != nil {
+			t.Errorf("foldHeader(%q) = %q: %v", value, folded, e)
+		} else if got := msg.Header.Get("Subject"); got != value {
+			t.Errorf("foldHeader(%q) unfolds to %q", value, got)
+		}
+	}
+}